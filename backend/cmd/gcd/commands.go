@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/models"
+	"github.com/mspcix/google-classroom-course-downloader/services"
+	"github.com/mspcix/google-classroom-course-downloader/storage"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+// Fetches the user's courses from Classroom into the database
+func runDiscover(args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	user := flags.String("user", "", "Classroom ID of the user")
+	sync := flags.Bool("sync", false, "sync the courses already in the database")
+	states := flags.String("states", "", "comma separated course states, defaults to DISCOVER_COURSE_STATES")
+	studentID := flags.String("student", "", "only the courses this user studies (\"me\", an ID or an email)")
+	teacherID := flags.String("teacher", "", "only the courses this user teaches (\"me\", an ID or an email)")
+	flags.Parse(args)
+
+	gcuid, err := resolveUser(*user)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *states != "" {
+		query.Set("courseStates", *states)
+	}
+	query.Set("studentId", *studentID)
+	query.Set("teacherId", *teacherID)
+	filter, err := services.ParseCourseFilter(query)
+	if err != nil {
+		return err
+	}
+
+	result, err := services.DiscoverCourses(context.Background(), gcuid, filter, *sync)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d course(s) discovered: %d new, %d synced (%d inserted, %d updated, %d removed)\n",
+		result.Discovered, result.New, result.Synced,
+		result.SyncStats.Inserted, result.SyncStats.Updated, result.SyncStats.Removed)
+	return nil
+}
+
+// Prints the courses the user is enrolled in
+func runList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	user := flags.String("user", "", "Classroom ID of the user")
+	flags.Parse(args)
+
+	gcuid, err := resolveUser(*user)
+	if err != nil {
+		return err
+	}
+
+	courses, err := database.GetCoursesByGCUID(gcuid)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tNAME")
+	for _, course := range courses {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", course.GCID, course.CourseState, course.Name)
+	}
+	return w.Flush()
+}
+
+// Downloads courses into a folder, only copying the files that changed since the last run
+func runDownload(args []string) error {
+	flags := flag.NewFlagSet("download", flag.ExitOnError)
+	user := flags.String("user", "", "Classroom ID of the user")
+	coursesFlag := flags.String("courses", "", "comma separated course IDs, defaults to every enrolled course")
+	layout := flags.String("layout", defaultLayout(), "folder layout, topic or date")
+	out := flags.String("out", "", "folder to download the courses to (required)")
+	flags.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+
+	keyPrefix, err := downloadCourses(*user, *coursesFlag, *layout)
+	if keyPrefix != "" {
+		defer storage.DeletePrefix(context.Background(), utils.ContentStorage, keyPrefix)
+	}
+	if err != nil {
+		return err
+	}
+
+	copied, skipped, err := utils.SyncToFolder(context.Background(), utils.ContentStorage, keyPrefix, *out)
+	if err != nil {
+		return fmt.Errorf("error copying files to %s: %w", *out, err)
+	}
+	fmt.Printf("Courses downloaded to %s: %d file(s) copied, %d unchanged\n", *out, copied, skipped)
+	return nil
+}
+
+// Downloads courses into a single archive file
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	user := flags.String("user", "", "Classroom ID of the user")
+	coursesFlag := flags.String("courses", "", "comma separated course IDs, defaults to every enrolled course")
+	layout := flags.String("layout", defaultLayout(), "folder layout, topic or date")
+	format := flags.String("format", "zip", "archive format, zip, tar.gz or tar.zst")
+	out := flags.String("out", "", "archive file to write (required)")
+	flags.Parse(args)
+
+	if *out == "" {
+		return fmt.Errorf("-out is required")
+	}
+	archiver, ok := utils.Archivers[*format]
+	if !ok {
+		return fmt.Errorf("unsupported format %q", *format)
+	}
+
+	keyPrefix, err := downloadCourses(*user, *coursesFlag, *layout)
+	if keyPrefix != "" {
+		defer storage.DeletePrefix(context.Background(), utils.ContentStorage, keyPrefix)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Write next to the destination first so a failed export doesn't replace a previous archive
+	tmpPath := *out + ".part"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := archiver.Archive(context.Background(), file, utils.ContentStorage, keyPrefix); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("error writing archive: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, *out); err != nil {
+		return err
+	}
+
+	fmt.Printf("Courses exported to %s\n", *out)
+	return nil
+}
+
+// Runs a download job for the user's courses and returns the storage key prefix of its files
+// The prefix is returned even on failure so the files can be removed
+func downloadCourses(user, coursesFlag, layout string) (string, error) {
+	gcuid, err := resolveUser(user)
+	if err != nil {
+		return "", err
+	}
+	if !models.IsValidLayout(layout) {
+		return "", fmt.Errorf("invalid layout %q", layout)
+	}
+
+	var coursesIDs []string
+	for _, id := range strings.Split(coursesFlag, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			coursesIDs = append(coursesIDs, id)
+		}
+	}
+	if len(coursesIDs) == 0 {
+		if coursesIDs, err = database.GetEnrolledCoursesGCIDs(gcuid); err != nil {
+			return "", err
+		}
+		if len(coursesIDs) == 0 {
+			return "", fmt.Errorf("no courses to download, run gcd discover first")
+		}
+	}
+
+	// Same check as the download route: users can only download the courses they are enrolled in
+	forbidden, err := database.GetNotEnrolledCoursesGCIDs(gcuid, coursesIDs)
+	if err != nil {
+		return "", err
+	}
+	if len(forbidden) > 0 {
+		return "", fmt.Errorf("not enrolled in course(s) %s", strings.Join(forbidden, ", "))
+	}
+
+	job, err := services.CreateDownloadJob(gcuid, coursesIDs, layout)
+	if err != nil {
+		return "", err
+	}
+	keyPrefix := utils.JobKeyPrefix(gcuid, job.ID)
+
+	if err := services.RunDownloadJob(*job); err != nil {
+		return keyPrefix, err
+	}
+
+	// A partial job still exports what it could, but its failed materials shouldn't go unnoticed in a cron log
+	report, err := services.GetJobReport(*job)
+	if err != nil {
+		return keyPrefix, err
+	}
+	for _, failure := range report.Failures {
+		fmt.Fprintf(os.Stderr, "failed: %s: %s\n", failure.FilePath, failure.Error)
+	}
+	if report.Failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d material(s) couldn't be downloaded\n", report.Failed, report.Done+report.Failed+report.Pending)
+	}
+	return keyPrefix, nil
+}
+
+func defaultLayout() string {
+	if layout := os.Getenv("DOWNLOAD_LAYOUT"); layout != "" {
+		return layout
+	}
+	return models.LayoutTopic
+}
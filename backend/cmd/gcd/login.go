@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/services"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+// How long login waits for the user to go through the consent screen
+const loginTimeout = 5 * time.Minute
+
+// Logs the user in through their browser, with a loopback redirect to a local server
+// The redirect URL, http://127.0.0.1:<port>/callback, must be allowed for the OAuth client
+func runLogin(args []string) error {
+	flags := flag.NewFlagSet("login", flag.ExitOnError)
+	port := flags.Int("port", 8085, "port of the local server receiving the OAuth redirect")
+	flags.Parse(args)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *port))
+	if err != nil {
+		return fmt.Errorf("error listening for the OAuth redirect: %w", err)
+	}
+
+	config := *utils.OAuthConfig
+	config.RedirectURL = fmt.Sprintf("http://127.0.0.1:%d/callback", *port)
+
+	state := utils.GenerateRandomID(32)
+	verifier, err := utils.GenerateCodeVerifier()
+	if err != nil {
+		return err
+	}
+
+	// Force the consent screen so Google sends a refresh token, needed to run unattended
+	opts := append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline, oauth2.ApprovalForce}, utils.CodeChallengeOptions(verifier)...)
+	fmt.Println("Open this URL in your browser to log in:")
+	fmt.Println(config.AuthCodeURL(state, opts...))
+
+	// Only the first callback is taken, the ones after it mustn't block their handler
+	type loginResult struct {
+		code string
+		err  error
+	}
+	resultCh := make(chan loginResult, 1)
+	var finishOnce sync.Once
+	finish := func(result loginResult) {
+		finishOnce.Do(func() { resultCh <- result })
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		switch {
+		case query.Get("error") != "":
+			http.Error(w, "Login failed, you can close this tab.", http.StatusBadRequest)
+			finish(loginResult{err: fmt.Errorf("login failed: %s", query.Get("error"))})
+		case query.Get("state") != state:
+			http.Error(w, "Invalid state parameter", http.StatusBadRequest)
+		default:
+			fmt.Fprintln(w, "Logged in, you can close this tab.")
+			finish(loginResult{code: query.Get("code")})
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	var code string
+	select {
+	case result := <-resultCh:
+		if result.err != nil {
+			return result.err
+		}
+		code = result.code
+	case <-time.After(loginTimeout):
+		return errors.New("timed out waiting for the login")
+	}
+
+	ctx := context.Background()
+	token, err := config.Exchange(ctx, code, utils.CodeVerifierOption(verifier))
+	if err != nil {
+		return fmt.Errorf("error exchanging code for token: %w", err)
+	}
+
+	user, err := services.PopulateUserProfile(ctx, token)
+	if err != nil {
+		return fmt.Errorf("error getting user profile: %w", err)
+	}
+	if err := database.SaveUser(*user); err != nil {
+		return fmt.Errorf("error saving user to the database: %w", err)
+	}
+	services.ResetUserTokenSource(user.GCUID)
+
+	if err := saveCurrentUser(user.GCUID); err != nil {
+		return err
+	}
+	fmt.Printf("Logged in as %s (%s)\n", user.Username, user.Email)
+	return nil
+}
+
+// File remembering the last user logged in
+func currentUserFile() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "gcd", "user"), nil
+}
+
+func saveCurrentUser(gcuid string) error {
+	path, err := currentUserFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(gcuid+"\n"), 0600)
+}
+
+// Returns the user to act for: the -user flag, GCD_USER, or the last user logged in
+func resolveUser(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+	if gcuid := os.Getenv("GCD_USER"); gcuid != "" {
+		return gcuid, nil
+	}
+
+	path, err := currentUserFile()
+	if err != nil {
+		return "", err
+	}
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", errors.New("no user logged in, run gcd login first")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,72 @@
+// Command gcd runs the downloader without the web frontend, e.g. for nightly backups from cron.
+//
+// Usage:
+//
+//	gcd login [-port 8085]
+//	gcd discover [-sync] [-states ACTIVE,ARCHIVED] [-student me] [-teacher me]
+//	gcd list
+//	gcd download -out DIR [-courses ID,ID] [-layout topic|date]
+//	gcd export -out FILE [-courses ID,ID] [-layout topic|date] [-format zip|tar.gz|tar.zst]
+//
+// Like the server, gcd reads its configuration from the .env file of the working directory.
+// Every command but login acts for the user given with -user, GCD_USER, or the last one logged in.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+var commands = map[string]func(args []string) error{
+	"login":    runLogin,
+	"discover": runDiscover,
+	"list":     runList,
+	"download": runDownload,
+	"export":   runExport,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "gcd: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := initialize(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "gcd %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gcd <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands: login, discover, list, download, export")
+	fmt.Fprintln(os.Stderr, "run gcd <command> -h for the flags of a command")
+}
+
+// Loads the environment, the OAuth config and the database like the server does
+func initialize() error {
+	if err := utils.InitEnv(); err != nil {
+		return fmt.Errorf("error initializing the environment: %w", err)
+	}
+	if err := utils.InitOauthConfig(); err != nil {
+		return fmt.Errorf("error initializing the OAuth config: %w", err)
+	}
+	if _, err := database.InitDB(); err != nil {
+		return fmt.Errorf("error initializing the database: %w", err)
+	}
+	return nil
+}
@@ -2,13 +2,15 @@ package database
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/mspcix/google-classroom-course-downloader/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// Insert a list of courses into the database.
-func SaveCourses(courses []models.Course) (err error) {
+// Insert a list of courses into the database, their content being visible to the given user.
+func SaveCourses(courses []models.Course, gcuid string) (err error) {
 	tx := db.Begin()
 	defer func() {
 		if r := recover(); r != nil {
@@ -28,6 +30,11 @@ func SaveCourses(courses []models.Course) (err error) {
 		return fmt.Errorf("error creating courses: %w", result.Error)
 	}
 
+	if err = setCoursesVisible(tx, gcuid, courses); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	if err = tx.Commit().Error; err != nil {
 		return fmt.Errorf("error committing transaction: %w", err)
 	}
@@ -35,7 +42,7 @@ func SaveCourses(courses []models.Course) (err error) {
 	return nil
 }
 
-// Retrieve a paginated list of courses' IDs from the database.
+// Retrieve the IDs of every course in the database, whichever users are enrolled in them.
 func GetCoursesGCIDs() ([]string, error) {
 	var coursesIDs []string
 	result := db.Model(&models.Course{}).Pluck("gcid", &coursesIDs)
@@ -49,28 +56,102 @@ func GetCoursesGCIDs() ([]string, error) {
 	return coursesIDs, nil
 }
 
-// Returns all Courses of a user
+// Retrieve the IDs of the courses a user is enrolled in.
+func GetEnrolledCoursesGCIDs(gcuid string) ([]string, error) {
+	var coursesIDs []string
+	result := db.Model(&models.Enrollment{}).Where("user_gcid = ?", gcuid).Pluck("course_gcid", &coursesIDs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("error retrieving enrolled courses IDs from the database: %w", result.Error)
+	}
+	return coursesIDs, nil
+}
+
+// Returns the course IDs, among the given ones, the user isn't enrolled in
+func GetNotEnrolledCoursesGCIDs(gcuid string, coursesIDs []string) ([]string, error) {
+	enrolledCoursesIDs := []string{}
+	result := db.Model(&models.Enrollment{}).
+		Where("user_gcid = ? AND course_gcid IN ?", gcuid, coursesIDs).
+		Pluck("course_gcid", &enrolledCoursesIDs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("error retrieving enrolled courses IDs from the database: %w", result.Error)
+	}
+
+	enrolled := make(map[string]bool, len(enrolledCoursesIDs))
+	for _, id := range enrolledCoursesIDs {
+		enrolled[id] = true
+	}
+
+	notEnrolled := []string{}
+	for _, id := range coursesIDs {
+		if !enrolled[id] {
+			notEnrolled = append(notEnrolled, id)
+		}
+	}
+	return notEnrolled, nil
+}
+
+// Enrolls a user in courses, skipping the ones they are already enrolled in
+func EnrollUser(gcuid string, coursesIDs []string) error {
+	if len(coursesIDs) == 0 {
+		return nil
+	}
+
+	enrollments := make([]models.Enrollment, len(coursesIDs))
+	for i, courseID := range coursesIDs {
+		enrollments[i] = models.Enrollment{UserGCID: gcuid, CourseGCID: courseID}
+	}
+
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&enrollments)
+	if result.Error != nil {
+		return fmt.Errorf("error enrolling user in courses: %w", result.Error)
+	}
+	return nil
+}
+
+// Returns all Courses a user is enrolled in
 func GetCoursesByGCUID(gcuid string) ([]models.Course, error) {
-	// Fetch the user by their token
 	var courses []models.Course
-	if err := db.Where("user_gcid_f = ?", gcuid).Preload("Announcements.Materials").Preload("CourseWorkMaterials.Materials").Find(&courses).Error; err != nil {
+	if err := preloadVisibleContent(db, gcuid).
+		Joins("JOIN enrollments ON enrollments.course_gcid = courses.gcid").
+		Where("enrollments.user_gcid = ?", gcuid).
+		Find(&courses).Error; err != nil {
 		return nil, err
 	}
 
 	return courses, nil
 }
 
-// Retrieves courses with the given course IDs
-func GetCoursesByIDs(coursesIDs []string) ([]models.Course, error) {
+// Retrieves courses with the given course IDs, with the submissions of the given user
+func GetCoursesByIDs(coursesIDs []string, gcuid string) ([]models.Course, error) {
 	var courses []models.Course
 
-	if err := db.Where("gcid IN ?", coursesIDs).Preload("Announcements.Materials").Preload("CourseWorkMaterials.Materials").Find(&courses).Error; err != nil {
+	if err := preloadVisibleContent(db, gcuid).Where("gcid IN ?", coursesIDs).Find(&courses).Error; err != nil {
 		return nil, err
 	}
 
 	return courses, nil
 }
 
+// Preloads the content of courses, with the Drive files of the materials for naming them
+// Submissions are personal, only those of the given user are loaded
+// Other items are loaded whichever users see them, as syncs need them all
+func preloadCourseContent(tx *gorm.DB, gcuid string) *gorm.DB {
+	return tx.Preload("Announcements.Materials.DriveFile").
+		Preload("CourseWorkMaterials.Materials.DriveFile").
+		Preload("CourseWork.Materials.DriveFile").
+		Preload("CourseWork.Submissions", "user_gcid = ?", gcuid).
+		Preload("CourseWork.Submissions.Materials.DriveFile").
+		Preload("Topics")
+}
+
+// Preloads the content of courses as the given user sees it in Classroom
+func preloadVisibleContent(tx *gorm.DB, gcuid string) *gorm.DB {
+	return preloadCourseContent(tx, gcuid).
+		Preload("Announcements", visibleTo(gcuid, models.ItemTypeAnnouncement, "id")).
+		Preload("CourseWorkMaterials", visibleTo(gcuid, models.ItemTypeCourseWorkMaterial, "cwmpid")).
+		Preload("CourseWork", visibleTo(gcuid, models.ItemTypeCourseWork, "cwpid"))
+}
+
 // Retrieves the drive file ID from a material's ID
 func GetDriveFileID(materialID uint) (string, error) {
 	var driveFileID string
@@ -85,6 +166,20 @@ func GetDriveFileID(materialID uint) (string, error) {
 	return driveFileID, nil
 }
 
+// Stores the Drive metadata of a file on every material pointing to it
+func UpdateDriveFileMetadata(driveFileID, md5Checksum string, size int64, mimeType string, modifiedTime *time.Time) error {
+	result := db.Model(&models.DriveFile{}).Where("drive_file_drive_file_id = ?", driveFileID).Updates(map[string]interface{}{
+		"md5_checksum":  md5Checksum,
+		"size":          size,
+		"mime_type":     mimeType,
+		"modified_time": modifiedTime,
+	})
+	if result.Error != nil {
+		return fmt.Errorf("error updating metadata of drive file %s: %w", driveFileID, result.Error)
+	}
+	return nil
+}
+
 // Retrieves the drive file ID from a material's Title
 func GetDriveFileIDByTitle(title string) (string, error) {
 	var driveFileID string
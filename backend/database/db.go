@@ -5,8 +5,10 @@ import (
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 	"github.com/mspcix/google-classroom-course-downloader/models"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"log"
 	"os"
 )
 
@@ -33,26 +35,147 @@ func InitDB() (*gorm.DB, error) {
 	connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s sslmode=verify-full",
 		os.Getenv("NDB_USER"), os.Getenv("NDB_PASSWORD"), os.Getenv("NDB_NAME"), os.Getenv("NDB_HOST"))
 
-	// Open a connection to the database using GORM
-	var err error
-	db, err = gorm.Open(postgres.New(postgres.Config{
+	return Open(postgres.New(postgres.Config{
 		DSN:                  connStr,
 		PreferSimpleProtocol: true,
-	}), &gorm.Config{
+	}))
+}
+
+// Opens the database through dialector and migrates it
+// InitDB opens the PostgreSQL database, tests open others
+func Open(dialector gorm.Dialector) (*gorm.DB, error) {
+	// Open a connection to the database using GORM
+	var err error
+	db, err = gorm.Open(dialector, &gorm.Config{
 		SkipDefaultTransaction: true,
 		//Logger:                 logger.Default.LogMode(logger.Info),
 		//Logger:                 utils.DBLogger.LoggerInterface,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to PostgreSQL: %w", err)
+		return nil, fmt.Errorf("error connecting to the database: %w", err)
 	}
 
 	// Disable Logger to suppress GORM logging output for this operation
 	// db.Logger = logger.Default.LogMode(logger.Silent)
 
-	if err := db.AutoMigrate(&models.User{}, &models.Course{}, &models.Announcement{}, &models.Material{}, &models.DriveFile{}, &models.YoutubeVideo{}, &models.Link{}, &models.Form{}, &models.CourseWorkMaterial{}); err != nil {
+	if err := db.AutoMigrate(&models.User{}, &models.Enrollment{}); err != nil {
+		return nil, fmt.Errorf("error automigrating models: %w", err)
+	}
+
+	if err := reencryptTokens(); err != nil {
+		return nil, fmt.Errorf("error re-encrypting tokens: %w", err)
+	}
+
+	if err := migrateCourseOwners(); err != nil {
+		return nil, fmt.Errorf("error migrating course owners: %w", err)
+	}
+
+	trackedVisibility := db.Migrator().HasTable(&models.ItemVisibility{})
+
+	if err := migrateMaterialDownloadKinds(); err != nil {
+		return nil, fmt.Errorf("error migrating material download states: %w", err)
+	}
+
+	if err := db.AutoMigrate(&models.Course{}, &models.Announcement{}, &models.Material{}, &models.DriveFile{}, &models.YoutubeVideo{}, &models.Link{}, &models.Form{}, &models.CourseWorkMaterial{}, &models.CourseWork{}, &models.StudentSubmission{}, &models.Topic{}, &models.ItemVisibility{}, &models.Job{}, &models.MaterialDownload{}); err != nil {
 		return nil, fmt.Errorf("error automigrating models: %w", err)
 	}
 
+	if !trackedVisibility {
+		if err := backfillItemVisibilities(); err != nil {
+			return nil, fmt.Errorf("error backfilling item visibilities: %w", err)
+		}
+	}
+
 	return db, nil
 }
+
+// Encrypts the tokens stored in plaintext and the ones encrypted with a rotated key
+// Reads and writes the raw columns so the stored values are seen as they are
+func reencryptTokens() error {
+	var rows []struct {
+		ID           uint
+		Token        string
+		RefreshToken string
+	}
+	if err := db.Table("users").Select("id, token, refresh_token").Scan(&rows).Error; err != nil {
+		return fmt.Errorf("error retrieving tokens: %w", err)
+	}
+
+	reencrypted := 0
+	for _, row := range rows {
+		if !utils.NeedsTokenReencryption(row.Token) && !utils.NeedsTokenReencryption(row.RefreshToken) {
+			continue
+		}
+
+		updates := make(map[string]interface{}, 2)
+		for column, stored := range map[string]string{"token": row.Token, "refresh_token": row.RefreshToken} {
+			token, err := utils.DecryptToken(stored)
+			if err != nil {
+				return fmt.Errorf("error decrypting %s of user %d: %w", column, row.ID, err)
+			}
+			if updates[column], err = utils.EncryptToken(token); err != nil {
+				return fmt.Errorf("error encrypting %s of user %d: %w", column, row.ID, err)
+			}
+		}
+
+		if err := db.Table("users").Where("id = ?", row.ID).Updates(updates).Error; err != nil {
+			return fmt.Errorf("error updating tokens of user %d: %w", row.ID, err)
+		}
+		reencrypted++
+	}
+
+	if reencrypted > 0 {
+		log.Printf("Re-encrypted the tokens of %d user(s)", reencrypted)
+	}
+	return nil
+}
+
+// Courses used to belong to a single user through courses.user_gcid_f
+// Turns those owners into enrollments and drops the column
+func migrateCourseOwners() error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&models.Course{}) || !migrator.HasColumn(&models.Course{}, "user_gcid_f") {
+		return nil
+	}
+
+	result := db.Exec(`INSERT INTO enrollments (user_gcid, course_gcid, created_at)
+		SELECT DISTINCT user_gcid_f, gcid, NOW() FROM courses
+		ON CONFLICT DO NOTHING`)
+	if result.Error != nil {
+		return fmt.Errorf("error creating enrollments: %w", result.Error)
+	}
+
+	return migrator.DropColumn(&models.Course{}, "user_gcid_f")
+}
+
+// Download states were only kept for materials, keyed by job and material
+// The kind added to the key can't be migrated in place, so the table is rebuilt with the states as materials
+func migrateMaterialDownloadKinds() error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&models.MaterialDownload{}) || migrator.HasColumn(&models.MaterialDownload{}, "kind") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var states []models.MaterialDownload
+		if err := tx.Table("material_downloads").Omit("kind").Find(&states).Error; err != nil {
+			return fmt.Errorf("error retrieving states: %w", err)
+		}
+		if err := tx.Migrator().DropTable(&models.MaterialDownload{}); err != nil {
+			return fmt.Errorf("error dropping table: %w", err)
+		}
+		if err := tx.AutoMigrate(&models.MaterialDownload{}); err != nil {
+			return fmt.Errorf("error creating table: %w", err)
+		}
+		if len(states) == 0 {
+			return nil
+		}
+		for i := range states {
+			states[i].Kind = models.MaterialDownloadKindMaterial
+		}
+		if err := tx.CreateInBatches(&states, 100).Error; err != nil {
+			return fmt.Errorf("error restoring states: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/mspcix/google-classroom-course-downloader/models"
+)
+
+// States recorded before their kind was part of the key are kept as states of materials
+func TestMigrateMaterialDownloadKinds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gcd.db")
+	old, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Exec(`CREATE TABLE material_downloads (job_id_f text, material_id_f integer, title text, status text NOT NULL,
+		file_path text, bytes_written integer, checksum text, error text, updated_at datetime, PRIMARY KEY (job_id_f, material_id_f))`).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Exec(`INSERT INTO material_downloads (job_id_f, material_id_f, title, status, file_path) VALUES ('job', 7, 'Syllabus.pdf', 'done', 'job/Syllabus.pdf')`).Error; err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := old.DB()
+	sqlDB.Close()
+
+	migrated, err := Open(sqlite.Open(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ = migrated.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+
+	states, err := GetMaterialDownloads("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states[0].Kind != models.MaterialDownloadKindMaterial || states[0].MaterialID != 7 || states[0].Status != models.MaterialDownloadDone {
+		t.Fatalf("got states %+v, want the done material 7", states)
+	}
+
+	// Item files of the same ID no longer collide with the material
+	text := models.MaterialDownload{JobID: "job", Kind: "announcementText", MaterialID: 7, Status: models.MaterialDownloadDone}
+	if err := SaveMaterialDownload(&text); err != nil {
+		t.Fatal(err)
+	}
+	if states, err := GetMaterialDownloads("job"); err != nil || len(states) != 2 {
+		t.Errorf("got states %+v, want the material and the text: %v", states, err)
+	}
+}
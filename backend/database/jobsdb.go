@@ -0,0 +1,107 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mspcix/google-classroom-course-downloader/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Insert a new download job into the database.
+func SaveJob(job *models.Job) error {
+	result := db.Create(job)
+	if result.Error != nil {
+		return fmt.Errorf("error inserting job into the database: %w", result.Error)
+	}
+	return nil
+}
+
+// Returns the job with the given ID, or nil if it doesn't exist
+func GetJobByID(jobID string) (*models.Job, error) {
+	var job models.Job
+	result := db.Where("id = ?", jobID).First(&job)
+	if result.Error != nil {
+		if result.Error == gorm.ErrRecordNotFound {
+			return nil, nil // Job does not exist
+		}
+		return nil, fmt.Errorf("error retrieving job from the database: %w", result.Error)
+	}
+	return &job, nil
+}
+
+// Updates the status of a job, stamping the start and finish times on the way
+func UpdateJobStatus(jobID string, status models.JobStatus, errMsg string) error {
+	updates := map[string]interface{}{
+		"status": status,
+		"error":  errMsg,
+	}
+	switch status {
+	case models.JobStatusRunning:
+		updates["started_at"] = time.Now()
+	case models.JobStatusDone, models.JobStatusFailed, models.JobStatusPartial:
+		updates["finished_at"] = time.Now()
+	}
+
+	result := db.Model(&models.Job{}).Where("id = ?", jobID).Updates(updates)
+	if result.Error != nil {
+		return fmt.Errorf("error updating job in the database: %w", result.Error)
+	}
+	return nil
+}
+
+// Returns the jobs in one of the given statuses
+func GetJobsByStatus(statuses ...models.JobStatus) ([]models.Job, error) {
+	var jobs []models.Job
+	result := db.Where("status IN ?", statuses).Order("created_at").Find(&jobs)
+	if result.Error != nil {
+		return nil, fmt.Errorf("error retrieving jobs from the database: %w", result.Error)
+	}
+	return jobs, nil
+}
+
+// Takes or renews the lease of a job for owner until now + ttl
+// Reports false if another owner holds a lease that hasn't expired
+func ClaimJob(jobID, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	result := db.Model(&models.Job{}).
+		Where("id = ? AND (owner = ? OR owner IS NULL OR owner = '' OR lease_expires_at IS NULL OR lease_expires_at < ?)", jobID, owner, now).
+		Updates(map[string]interface{}{
+			"owner":            owner,
+			"lease_expires_at": now.Add(ttl),
+		})
+	if result.Error != nil {
+		return false, fmt.Errorf("error claiming job %s: %w", jobID, result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Gives up the lease owner holds on a job
+func ReleaseJob(jobID, owner string) error {
+	result := db.Model(&models.Job{}).Where("id = ? AND owner = ?", jobID, owner).
+		Updates(map[string]interface{}{"owner": "", "lease_expires_at": nil})
+	if result.Error != nil {
+		return fmt.Errorf("error releasing job %s: %w", jobID, result.Error)
+	}
+	return nil
+}
+
+// Inserts or replaces the download state of a material
+func SaveMaterialDownload(state *models.MaterialDownload) error {
+	result := db.Clauses(clause.OnConflict{UpdateAll: true}).Create(state)
+	if result.Error != nil {
+		return fmt.Errorf("error saving download state of %s %d: %w", state.Kind, state.MaterialID, result.Error)
+	}
+	return nil
+}
+
+// Returns the download states of a job's materials and item files
+func GetMaterialDownloads(jobID string) ([]models.MaterialDownload, error) {
+	var states []models.MaterialDownload
+	result := db.Where("job_id_f = ?", jobID).Find(&states)
+	if result.Error != nil {
+		return nil, fmt.Errorf("error retrieving download states of job %s: %w", jobID, result.Error)
+	}
+	return states, nil
+}
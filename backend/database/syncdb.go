@@ -0,0 +1,268 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mspcix/google-classroom-course-downloader/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Number of rows inserted, updated and marked as removed by a sync
+type SyncStats struct {
+	Inserted int
+	Updated  int
+	Removed  int
+}
+
+func (s *SyncStats) Add(other SyncStats) {
+	s.Inserted += other.Inserted
+	s.Updated += other.Updated
+	s.Removed += other.Removed
+}
+
+// Brings a course already in the database up to date with its state in Classroom.
+// Changed rows are updated, new ones inserted and the ones missing from Classroom marked as removed.
+// Only the submissions of the given user are synced, as they are the only ones Classroom returns.
+// Content is shared between enrolled users but Classroom only returns what the user sees,
+// so items missing from their view are hidden from them and only removed once no user sees them.
+func SyncCourse(course models.Course, gcuid string) (stats SyncStats, err error) {
+	tx := db.Begin()
+	defer func() {
+		if r := recover(); r != nil {
+			tx.Rollback()
+			err = fmt.Errorf("panic recovered: %v", r)
+		}
+	}()
+
+	if err = tx.Error; err != nil {
+		return stats, fmt.Errorf("error starting transaction: %w", err)
+	}
+
+	if stats, err = syncCourse(tx, course, gcuid); err != nil {
+		tx.Rollback()
+		return stats, fmt.Errorf("error syncing course %s: %w", course.GCID, err)
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		return stats, fmt.Errorf("error committing transaction: %w", err)
+	}
+
+	return stats, nil
+}
+
+func syncCourse(tx *gorm.DB, course models.Course, gcuid string) (SyncStats, error) {
+	var stats SyncStats
+
+	var stored models.Course
+	if err := preloadCourseContent(tx, gcuid).Where("gcid = ?", course.GCID).First(&stored).Error; err != nil {
+		return stats, err
+	}
+
+	if !course.UpdateTime.Equal(stored.UpdateTime) {
+		err := tx.Model(&stored).Select("*").Omit("ID", clause.Associations).Updates(&course).Error
+		if err != nil {
+			return stats, fmt.Errorf("error updating course: %w", err)
+		}
+		stats.Updated++
+	}
+
+	steps := []func() (SyncStats, error){
+		func() (SyncStats, error) {
+			return syncItems(tx, &stored, "Announcements", visibility{gcuid, models.ItemTypeAnnouncement}, stored.Announcements, course.Announcements)
+		},
+		func() (SyncStats, error) {
+			return syncItems(tx, &stored, "CourseWorkMaterials", visibility{gcuid, models.ItemTypeCourseWorkMaterial}, stored.CourseWorkMaterials, course.CourseWorkMaterials)
+		},
+		func() (SyncStats, error) {
+			return syncItems(tx, &stored, "CourseWork", visibility{gcuid, models.ItemTypeCourseWork}, stored.CourseWork, course.CourseWork)
+		},
+		func() (SyncStats, error) {
+			return syncSubmissions(tx, stored.CourseWork, course.CourseWork)
+		},
+		func() (SyncStats, error) {
+			return syncItems(tx, &stored, "Topics", visibility{}, stored.Topics, course.Topics)
+		},
+		func() (SyncStats, error) {
+			return SyncStats{}, syncTopicPositions(tx, stored.Topics, course.Topics)
+		},
+	}
+	for _, step := range steps {
+		stepStats, err := step()
+		if err != nil {
+			return stats, err
+		}
+		stats.Add(stepStats)
+	}
+
+	return stats, nil
+}
+
+// Syncs the items of an owner's association (e.g. a course's announcements)
+// stored holds the items in the database, fetched the ones returned by Classroom
+// When visible tracks the items, a stored item missing from fetched is only removed once no user sees it
+func syncItems[T any, PT interface {
+	*T
+	models.SyncedItem
+}](tx *gorm.DB, owner interface{}, association string, visible visibility, stored, fetched []T) (SyncStats, error) {
+	var stats SyncStats
+
+	storedByGCID := make(map[string]PT, len(stored))
+	for i := range stored {
+		item := PT(&stored[i])
+		storedByGCID[item.GetGCID()] = item
+	}
+
+	seen := make(map[string]bool, len(fetched))
+	var newItems []T
+	var seenIDs []uint
+	for i := range fetched {
+		item := PT(&fetched[i])
+		seen[item.GetGCID()] = true
+
+		old, ok := storedByGCID[item.GetGCID()]
+		if ok {
+			seenIDs = append(seenIDs, old.GetID())
+		}
+		switch {
+		case !ok:
+			newItems = append(newItems, fetched[i])
+		case old.GetUpdateTime() != item.GetUpdateTime() || old.GetRemovedAt() != nil:
+			if err := updateItem(tx, old, item); err != nil {
+				return stats, err
+			}
+			stats.Updated++
+		}
+	}
+
+	if len(newItems) > 0 {
+		if err := tx.Model(owner).Association(association).Append(&newItems); err != nil {
+			return stats, fmt.Errorf("error inserting %s: %w", association, err)
+		}
+		stats.Inserted += len(newItems)
+		seenIDs = append(seenIDs, itemIDs[T, PT](newItems)...)
+	}
+
+	if visible.tracked() {
+		if err := setItemsVisible(tx, visible.userGCID, visible.itemType, seenIDs); err != nil {
+			return stats, err
+		}
+	}
+
+	now := time.Now()
+	for gcid, old := range storedByGCID {
+		if seen[gcid] {
+			continue
+		}
+		if visible.tracked() {
+			seenByOthers, err := hideItem(tx, visible.userGCID, visible.itemType, old.GetID())
+			if err != nil {
+				return stats, err
+			}
+			if seenByOthers {
+				continue
+			}
+		}
+		if old.GetRemovedAt() != nil {
+			continue
+		}
+		if err := tx.Model(old).Update("removed_at", now).Error; err != nil {
+			return stats, fmt.Errorf("error marking %s as removed: %w", association, err)
+		}
+		stats.Removed++
+	}
+
+	return stats, nil
+}
+
+// Overwrites a stored item with the one fetched from Classroom, keeping its keys
+// The materials of the item are replaced as a whole
+func updateItem[PT models.SyncedItem](tx *gorm.DB, old, item PT) error {
+	err := tx.Model(old).Select("*").Omit("ID", "CourseID", "CourseWorkID", clause.Associations).Updates(item).Error
+	if err != nil {
+		return fmt.Errorf("error updating item %s: %w", item.GetGCID(), err)
+	}
+
+	if err := deleteMaterials(tx, old.GetMaterials()); err != nil {
+		return err
+	}
+	if materials := item.GetMaterials(); len(materials) > 0 {
+		if err := tx.Model(old).Association("Materials").Append(&materials); err != nil {
+			return fmt.Errorf("error inserting materials of item %s: %w", item.GetGCID(), err)
+		}
+	}
+
+	return nil
+}
+
+// Syncs the submissions of the course work present both in the database and in Classroom
+func syncSubmissions(tx *gorm.DB, stored, fetched []models.CourseWork) (SyncStats, error) {
+	var stats SyncStats
+
+	fetchedByGCID := make(map[string]models.CourseWork, len(fetched))
+	for _, courseWork := range fetched {
+		fetchedByGCID[courseWork.GCID] = courseWork
+	}
+
+	for i := range stored {
+		courseWork, ok := fetchedByGCID[stored[i].GCID]
+		if !ok {
+			continue
+		}
+		submissionStats, err := syncItems(tx, &stored[i], "Submissions", visibility{}, stored[i].Submissions, courseWork.Submissions)
+		if err != nil {
+			return stats, err
+		}
+		stats.Add(submissionStats)
+	}
+
+	return stats, nil
+}
+
+// Reordering topics in Classroom doesn't change their update time
+func syncTopicPositions(tx *gorm.DB, stored, fetched []models.Topic) error {
+	positions := make(map[string]int, len(fetched))
+	for _, topic := range fetched {
+		positions[topic.GCID] = topic.Position
+	}
+
+	for _, topic := range stored {
+		position, ok := positions[topic.GCID]
+		if !ok || position == topic.Position {
+			continue
+		}
+		if err := tx.Model(&topic).Update("position", position).Error; err != nil {
+			return fmt.Errorf("error updating topic position: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Deletes materials along with their drive file, video, link and form
+func deleteMaterials(tx *gorm.DB, materials []models.Material) error {
+	if len(materials) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(materials))
+	materialIDs := make([]string, len(materials))
+	for i, material := range materials {
+		ids[i] = material.ID
+		materialIDs[i] = strconv.FormatUint(uint64(material.ID), 10)
+	}
+
+	for _, model := range []interface{}{&models.DriveFile{}, &models.YoutubeVideo{}, &models.Link{}, &models.Form{}} {
+		if err := tx.Where("material_id_f IN ?", materialIDs).Delete(model).Error; err != nil {
+			return fmt.Errorf("error deleting attachments of materials: %w", err)
+		}
+	}
+
+	if err := tx.Delete(&models.Material{}, ids).Error; err != nil {
+		return fmt.Errorf("error deleting materials: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+
+	"github.com/mspcix/google-classroom-course-downloader/models"
+)
+
+const (
+	studentA = "100000000000000000001"
+	studentB = "100000000000000000002"
+)
+
+func setupDB(t *testing.T) {
+	t.Helper()
+	db, err := Open(sqlite.Open(filepath.Join(t.TempDir(), "gcd.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+}
+
+// The course as a student sees it in Classroom, with the given announcements and course work
+func courseView(announcements, courseWork []string) models.Course {
+	course := models.Course{GCID: "course-1", Name: "Algorithms"}
+	for _, gcid := range announcements {
+		course.Announcements = append(course.Announcements, models.Announcement{GCID: gcid, UpdateTime: "2023-01-02T10:00:00Z"})
+	}
+	for _, gcid := range courseWork {
+		course.CourseWork = append(course.CourseWork, models.CourseWork{GCID: gcid, UpdateTime: "2023-01-02T10:00:00Z"})
+	}
+	return course
+}
+
+// Returns the Classroom IDs of the announcements and course work a user is shown, with the removed ones
+func visibleContent(t *testing.T, gcuid string) (announcements, courseWork, removed []string) {
+	t.Helper()
+	courses, err := GetCoursesByGCUID(gcuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(courses) != 1 {
+		t.Fatalf("%s is enrolled in %d courses, want 1", gcuid, len(courses))
+	}
+	for _, announcement := range courses[0].Announcements {
+		announcements = append(announcements, announcement.GCID)
+		if announcement.RemovedAt != nil {
+			removed = append(removed, announcement.GCID)
+		}
+	}
+	for _, cw := range courses[0].CourseWork {
+		courseWork = append(courseWork, cw.GCID)
+		if cw.RemovedAt != nil {
+			removed = append(removed, cw.GCID)
+		}
+	}
+	sort.Strings(announcements)
+	sort.Strings(courseWork)
+	return announcements, courseWork, removed
+}
+
+func equal(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Two students of a course see different items, assigned to one of them only
+// Each one's syncs must show them their own items and leave the other's alone
+func TestSyncCourseScopesItemsPerUser(t *testing.T) {
+	setupDB(t)
+
+	// B discovers the course first, with an announcement and a course work assigned to them only
+	if err := SaveCourses([]models.Course{courseView([]string{"announcement-1", "announcement-b"}, []string{"coursework-1", "coursework-b"})}, studentB); err != nil {
+		t.Fatal(err)
+	}
+	if err := EnrollUser(studentB, []string{"course-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A joins, seeing only the items assigned to the whole class
+	stats, err := SyncCourse(courseView([]string{"announcement-1"}, []string{"coursework-1"}), studentA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EnrollUser(studentA, []string{"course-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 0 {
+		t.Errorf("A's sync removed %d items seen by B", stats.Removed)
+	}
+
+	announcements, courseWork, removed := visibleContent(t, studentA)
+	if !equal(announcements, []string{"announcement-1"}) || !equal(courseWork, []string{"coursework-1"}) {
+		t.Errorf("A is shown announcements %v and course work %v, want only the shared ones", announcements, courseWork)
+	}
+	courses, err := GetCoursesByIDs([]string{"course-1"}, studentA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(courses[0].Announcements) != 1 || len(courses[0].CourseWork) != 1 {
+		t.Errorf("A downloads %d announcements and %d course work, want 1 of each", len(courses[0].Announcements), len(courses[0].CourseWork))
+	}
+
+	announcements, courseWork, removed = visibleContent(t, studentB)
+	if !equal(announcements, []string{"announcement-1", "announcement-b"}) || !equal(courseWork, []string{"coursework-1", "coursework-b"}) {
+		t.Errorf("B is shown announcements %v and course work %v, want all of them", announcements, courseWork)
+	}
+	if len(removed) != 0 {
+		t.Errorf("%v marked as removed after A's sync", removed)
+	}
+
+	// Once no student sees B's announcement anymore, it is removed
+	stats, err = SyncCourse(courseView([]string{"announcement-1"}, []string{"coursework-1", "coursework-b"}), studentB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != 1 {
+		t.Errorf("B's sync removed %d items, want 1", stats.Removed)
+	}
+	if _, _, removed = visibleContent(t, studentA); len(removed) != 0 {
+		t.Errorf("%v shown to A as removed", removed)
+	}
+
+	// Shared items are only removed once hidden from everyone
+	if _, err := SyncCourse(courseView(nil, []string{"coursework-b"}), studentB); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, removed = visibleContent(t, studentA); len(removed) != 0 {
+		t.Errorf("%v removed while A still sees them", removed)
+	}
+	if _, err := SyncCourse(courseView(nil, nil), studentA); err != nil {
+		t.Fatal(err)
+	}
+	var announcement models.Announcement
+	if err := db.Where("gcid = ?", "announcement-1").First(&announcement).Error; err != nil {
+		t.Fatal(err)
+	}
+	if announcement.RemovedAt == nil {
+		t.Error("announcement-1 isn't removed once no student sees it")
+	}
+}
@@ -3,10 +3,8 @@ package database
 import (
 	"fmt"
 	"log"
-	"net/http"
 	"time"
 
-	"github.com/gorilla/sessions"
 	"github.com/mspcix/google-classroom-course-downloader/models"
 	"golang.org/x/oauth2"
 	"gorm.io/gorm"
@@ -40,12 +38,17 @@ func insertUser(user models.User) error {
 }
 
 func UpdateUserToken(user models.User) error {
-	result := db.Model(&models.User{}).Where("email = ?", user.Email).
-		Updates(map[string]interface{}{
-			"token":         user.Token,
-			"refresh_token": user.RefreshToken,
-			"updated_at":    time.Now(),
-		})
+	updates := map[string]interface{}{
+		"token":        user.Token,
+		"token_expiry": user.TokenExpiry,
+		"updated_at":   time.Now(),
+	}
+	// Google only sends a refresh token the first time the user consents
+	if user.RefreshToken != "" {
+		updates["refresh_token"] = user.RefreshToken
+	}
+
+	result := db.Model(&models.User{}).Where("gc_user_id = ?", user.GCUID).Updates(updates)
 	if result.Error != nil {
 		return fmt.Errorf("error updating user in the database: %w", result.Error)
 	}
@@ -72,87 +75,18 @@ func GetUserByGCUID(gcuid string) (*models.User, error) {
 	return nil, fmt.Errorf("THE 'USERS' TABLE DOESN'T EXIST IN THE DATABASE. PlEASE, RESTART THE SERVER")
 }
 
-// Get user's token from session data
-func GetTokenFromSession(r *http.Request, store sessions.Store) (string, error) {
-	// Retrieve the authenticated user's userID from the session
-	session, _ := store.Get(r, "gcd_session")
-	gcuid, ok := session.Values["gcuid"].(string)
-	if !ok {
-		log.Println("userID not found in session")
-		return "", fmt.Errorf("userID not found in session")
-	}
-
-	token, err := GetTokenByGCUID(gcuid)
-	if err != nil {
-		log.Println("Error retrieving token from the database:", err)
-		return "", err
+func UpdateToken(gcuid string, newToken *oauth2.Token) error {
+	updates := map[string]interface{}{
+		"token":        models.EncryptedString(newToken.AccessToken),
+		"token_expiry": newToken.Expiry,
+		"updated_at":   time.Now(),
 	}
-
-	return token, nil
-}
-
-func GetTokenByGCUID(gcuid string) (string, error) {
-	var user models.User
-
-	migrator := db.Migrator()
-	if migrator.HasTable(&user) {
-		result := db.Select("token").Where("gc_user_id = ?", gcuid).First(&user)
-		if result.Error != nil {
-			if result.Error == gorm.ErrRecordNotFound {
-				return "", nil // User does not exist
-			}
-			return "", fmt.Errorf("error retrieving user from the database: %w", result.Error)
-		}
-		return user.Token, nil
+	// Google doesn't always send a new refresh token, keep the stored one then
+	if newToken.RefreshToken != "" {
+		updates["refresh_token"] = models.EncryptedString(newToken.RefreshToken)
 	}
 
-	return "", fmt.Errorf("THE 'USERS' TABLE DOESN'T EXIST IN THE DATABASE")
-}
-
-func GetGCUIDByToken(token string) (string, error) {
-	var user models.User
-
-	migrator := db.Migrator()
-	if migrator.HasTable(&user) {
-		result := db.Select("gc_user_id").Where("token = ?", token).First(&user)
-		if result.Error != nil {
-			if result.Error == gorm.ErrRecordNotFound {
-				return "", nil // User does not exist
-			}
-			return "", fmt.Errorf("error retrieving user from the database: %w", result.Error)
-		}
-		return user.GCUID, nil
-	}
-
-	return "", fmt.Errorf("THE 'USERS' TABLE DOESN'T EXIST IN THE DATABASE")
-}
-
-func GetRefreshTokenByToken(token string) (string, error) {
-	var user models.User
-
-	migrator := db.Migrator()
-	if migrator.HasTable(&user) {
-		result := db.Select("refresh_token").Where("token = ?", token).First(&user)
-		if result.Error != nil {
-			if result.Error == gorm.ErrRecordNotFound {
-				return "", nil // User does not exist
-			}
-			return "", fmt.Errorf("error retrieving user from the database: %w", result.Error)
-		}
-		return user.RefreshToken, nil
-	}
-
-	return "", fmt.Errorf("THE 'USERS' TABLE DOESN'T EXIST IN THE DATABASE")
-}
-
-func UpdateToken(expiredToken string, newToken *oauth2.Token) error {
-	result := db.Model(&models.User{}).Where("token = ?", expiredToken).
-		Updates(map[string]interface{}{
-			"token":         newToken.AccessToken,
-			"token_expiry":  newToken.Expiry,
-			"refresh_token": newToken.RefreshToken,
-			"updated_at":    time.Now(),
-		})
+	result := db.Model(&models.User{}).Where("gc_user_id = ?", gcuid).Updates(updates)
 	if result.Error != nil {
 		return fmt.Errorf("error updating user in the database: %w", result.Error)
 	}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/mspcix/google-classroom-course-downloader/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The user a sync runs for and the kind of items it syncs
+// The zero value syncs items shared by every enrolled user, such as topics
+type visibility struct {
+	userGCID string
+	itemType string
+}
+
+func (v visibility) tracked() bool {
+	return v.itemType != ""
+}
+
+// Records that the given items are visible to a user
+func setItemsVisible(tx *gorm.DB, gcuid, itemType string, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	visibilities := make([]models.ItemVisibility, len(ids))
+	for i, id := range ids {
+		visibilities[i] = models.ItemVisibility{UserGCID: gcuid, ItemType: itemType, ItemID: id}
+	}
+
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(&visibilities, 100)
+	if result.Error != nil {
+		return fmt.Errorf("error recording visibility of %s items: %w", itemType, result.Error)
+	}
+	return nil
+}
+
+// Records that an item is no longer visible to a user
+// Returns whether other users still see it
+func hideItem(tx *gorm.DB, gcuid, itemType string, id uint) (bool, error) {
+	err := tx.Where("user_gcid = ? AND item_type = ? AND item_id = ?", gcuid, itemType, id).
+		Delete(&models.ItemVisibility{}).Error
+	if err != nil {
+		return false, fmt.Errorf("error hiding %s item %d: %w", itemType, id, err)
+	}
+
+	var count int64
+	if err := tx.Model(&models.ItemVisibility{}).Where("item_type = ? AND item_id = ?", itemType, id).Count(&count).Error; err != nil {
+		return false, fmt.Errorf("error counting users seeing %s item %d: %w", itemType, id, err)
+	}
+	return count > 0, nil
+}
+
+// Records the content of newly inserted courses as visible to the user who fetched it
+func setCoursesVisible(tx *gorm.DB, gcuid string, courses []models.Course) error {
+	for _, course := range courses {
+		if err := setItemsVisible(tx, gcuid, models.ItemTypeAnnouncement, itemIDs(course.Announcements)); err != nil {
+			return err
+		}
+		if err := setItemsVisible(tx, gcuid, models.ItemTypeCourseWorkMaterial, itemIDs(course.CourseWorkMaterials)); err != nil {
+			return err
+		}
+		if err := setItemsVisible(tx, gcuid, models.ItemTypeCourseWork, itemIDs(course.CourseWork)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func itemIDs[T any, PT interface {
+	*T
+	models.SyncedItem
+}](items []T) []uint {
+	ids := make([]uint, len(items))
+	for i := range items {
+		ids[i] = PT(&items[i]).GetID()
+	}
+	return ids
+}
+
+// Preloads only the items of a kind visible to a user, column being the items' primary key
+func visibleTo(gcuid, itemType, column string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where(column+" IN (?)", db.Model(&models.ItemVisibility{}).
+			Select("item_id").
+			Where("user_gcid = ? AND item_type = ?", gcuid, itemType))
+	}
+}
+
+// Content used to be visible to every enrolled user
+// Keeps it that way for the items stored before visibility was tracked
+func backfillItemVisibilities() error {
+	var enrollments []models.Enrollment
+	if err := db.Find(&enrollments).Error; err != nil {
+		return fmt.Errorf("error retrieving enrollments: %w", err)
+	}
+	usersByCourse := make(map[string][]string)
+	for _, enrollment := range enrollments {
+		usersByCourse[enrollment.CourseGCID] = append(usersByCourse[enrollment.CourseGCID], enrollment.UserGCID)
+	}
+
+	var courses []models.Course
+	if err := db.Preload("Announcements").Preload("CourseWorkMaterials").Preload("CourseWork").Find(&courses).Error; err != nil {
+		return fmt.Errorf("error retrieving courses: %w", err)
+	}
+
+	backfilled := 0
+	for _, course := range courses {
+		for _, gcuid := range usersByCourse[course.GCID] {
+			if err := setCoursesVisible(db, gcuid, []models.Course{course}); err != nil {
+				return err
+			}
+			backfilled++
+		}
+	}
+
+	if backfilled > 0 {
+		log.Printf("Made the content of %d enrollment(s) visible to their users", backfilled)
+	}
+	return nil
+}
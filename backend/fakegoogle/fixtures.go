@@ -0,0 +1,64 @@
+package fakegoogle
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+//go:embed fixtures/*.json
+var fixturesFS embed.FS
+
+// Data served by the fake server
+// Classroom resources are kept as raw JSON, in the shape the real API returns them
+type Fixtures struct {
+	// Page size used when a request doesn't ask for one
+	PageSize    int               `json:"pageSize"`
+	UserProfile json.RawMessage   `json:"userProfile"`
+	Courses     []json.RawMessage `json:"courses"`
+
+	// Resources of each course, by course ID
+	Announcements       map[string][]json.RawMessage `json:"announcements"`
+	CourseWorkMaterials map[string][]json.RawMessage `json:"courseWorkMaterials"`
+	CourseWork          map[string][]json.RawMessage `json:"courseWork"`
+	StudentSubmissions  map[string][]json.RawMessage `json:"studentSubmissions"`
+	Topics              map[string][]json.RawMessage `json:"topics"`
+
+	// Drive files, by file ID
+	DriveFiles map[string]DriveFile `json:"driveFiles"`
+}
+
+// A Drive file and its content
+// Google Workspace files return their content whatever the export format asked for
+type DriveFile struct {
+	Name         string `json:"name"`
+	MimeType     string `json:"mimeType"`
+	Content      string `json:"content"`
+	ModifiedTime string `json:"modifiedTime,omitempty"`
+}
+
+// Reads fixtures from JSON
+func LoadFixtures(r io.Reader) (*Fixtures, error) {
+	var fixtures Fixtures
+	if err := json.NewDecoder(r).Decode(&fixtures); err != nil {
+		return nil, fmt.Errorf("error decoding fixtures: %w", err)
+	}
+	return &fixtures, nil
+}
+
+// Returns the embedded fixtures: two courses, one spanning several pages of announcements,
+// with materials, course work, a submission, topics and their Drive files
+func DefaultFixtures() *Fixtures {
+	file, err := fixturesFS.Open("fixtures/default.json")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	fixtures, err := LoadFixtures(file)
+	if err != nil {
+		panic(err)
+	}
+	return fixtures
+}
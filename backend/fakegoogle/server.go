@@ -0,0 +1,241 @@
+// Package fakegoogle serves a fake Classroom and Drive API from fixtures,
+// to run discovery and downloads without reaching Google.
+// Point CLASSROOM_API_URL and DRIVE_API_URL to the server's URL to use it.
+package fakegoogle
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultPageSize = 2
+
+// Starts a fake Classroom and Drive server serving the fixtures
+// The caller must Close it
+func NewServer(fixtures *Fixtures) *httptest.Server {
+	return httptest.NewServer(NewHandler(fixtures))
+}
+
+// Returns the handler of the fake server, to mount it on another server
+func NewHandler(fixtures *Fixtures) http.Handler {
+	s := &server{fixtures: fixtures}
+
+	r := mux.NewRouter()
+	r.Use(requireBearerToken)
+
+	r.HandleFunc("/v1/userProfiles/me", s.handleUserProfile).Methods(http.MethodGet)
+	r.HandleFunc("/v1/courses", s.handleCourses).Methods(http.MethodGet)
+	r.HandleFunc("/v1/courses/{courseID}/announcements", s.handleCourseResource("announcements", fixtures.Announcements)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/courses/{courseID}/courseWorkMaterials", s.handleCourseResource("courseWorkMaterial", fixtures.CourseWorkMaterials)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/courses/{courseID}/courseWork", s.handleCourseResource("courseWork", fixtures.CourseWork)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/courses/{courseID}/courseWork/-/studentSubmissions", s.handleCourseResource("studentSubmissions", fixtures.StudentSubmissions)).Methods(http.MethodGet)
+	r.HandleFunc("/v1/courses/{courseID}/topics", s.handleCourseResource("topic", fixtures.Topics)).Methods(http.MethodGet)
+
+	r.HandleFunc("/drive/v3/files/{fileID}", s.handleDriveFile).Methods(http.MethodGet)
+	r.HandleFunc("/drive/v3/files/{fileID}/export", s.handleDriveExport).Methods(http.MethodGet)
+
+	return r
+}
+
+type server struct {
+	fixtures *Fixtures
+}
+
+// Rejects requests without an access token, as Google does
+func requireBearerToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			writeError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "Request is missing an access token.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) handleUserProfile(w http.ResponseWriter, r *http.Request) {
+	if len(s.fixtures.UserProfile) == 0 {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Requested entity was not found.")
+		return
+	}
+	writeJSON(w, s.fixtures.UserProfile)
+}
+
+// Serves the courses, filtered by the courseStates parameters
+func (s *server) handleCourses(w http.ResponseWriter, r *http.Request) {
+	states := r.URL.Query()["courseStates"]
+	if len(states) == 0 {
+		s.writePage(w, r, "courses", s.fixtures.Courses)
+		return
+	}
+
+	courses := []json.RawMessage{}
+	for _, raw := range s.fixtures.Courses {
+		var course struct {
+			CourseState string `json:"courseState"`
+		}
+		if json.Unmarshal(raw, &course) != nil {
+			continue
+		}
+		for _, state := range states {
+			if course.CourseState == state {
+				courses = append(courses, raw)
+				break
+			}
+		}
+	}
+	s.writePage(w, r, "courses", courses)
+}
+
+// Serves a paginated list of a course's resources under key
+func (s *server) handleCourseResource(key string, byCourse map[string][]json.RawMessage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		courseID := mux.Vars(r)["courseID"]
+		if !s.hasCourse(courseID) {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "Requested entity was not found.")
+			return
+		}
+		s.writePage(w, r, key, byCourse[courseID])
+	}
+}
+
+func (s *server) hasCourse(courseID string) bool {
+	for _, raw := range s.fixtures.Courses {
+		var course struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(raw, &course) == nil && course.ID == courseID {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the page of items selected by the pageSize and pageToken parameters
+// Page tokens are the offset of the page's first item
+func (s *server) writePage(w http.ResponseWriter, r *http.Request, key string, items []json.RawMessage) {
+	pageSize := s.fixtures.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if value := r.URL.Query().Get("pageSize"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid pageSize.")
+			return
+		}
+		// Like Classroom, the server may return fewer items than asked for
+		if size > 0 && size < pageSize {
+			pageSize = size
+		}
+	}
+
+	offset := 0
+	if token := r.URL.Query().Get("pageToken"); token != "" {
+		var err error
+		offset, err = strconv.Atoi(token)
+		if err != nil || offset < 0 || offset > len(items) {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "Invalid pageToken.")
+			return
+		}
+	}
+
+	end := offset + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+
+	page := map[string]interface{}{}
+	if end > offset {
+		page[key] = items[offset:end]
+	}
+	if end < len(items) {
+		page["nextPageToken"] = strconv.Itoa(end)
+	}
+	writeJSON(w, page)
+}
+
+// Serves a Drive file's metadata, or its content with alt=media
+func (s *server) handleDriveFile(w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["fileID"]
+	file, ok := s.fixtures.DriveFiles[fileID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "File not found: "+fileID+".")
+		return
+	}
+
+	if r.URL.Query().Get("alt") == "media" {
+		if strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") {
+			writeError(w, http.StatusForbidden, "fileNotDownloadable", "Only files with binary content can be downloaded. Use Export with Docs Editors files.")
+			return
+		}
+		// ServeContent answers Range requests the way Drive does
+		w.Header().Set("Content-Type", file.MimeType)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(file.Content))
+		return
+	}
+
+	metadata := map[string]string{
+		"kind":     "drive#file",
+		"id":       fileID,
+		"name":     file.Name,
+		"mimeType": file.MimeType,
+	}
+	if file.ModifiedTime != "" {
+		metadata["modifiedTime"] = file.ModifiedTime
+	}
+	if !strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") {
+		sum := md5.Sum([]byte(file.Content))
+		metadata["size"] = strconv.Itoa(len(file.Content))
+		metadata["md5Checksum"] = hex.EncodeToString(sum[:])
+	}
+	writeJSON(w, metadata)
+}
+
+// Serves the content of a Google Workspace file in the requested format
+func (s *server) handleDriveExport(w http.ResponseWriter, r *http.Request) {
+	fileID := mux.Vars(r)["fileID"]
+	file, ok := s.fixtures.DriveFiles[fileID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "notFound", "File not found: "+fileID+".")
+		return
+	}
+
+	mimeType := r.URL.Query().Get("mimeType")
+	if mimeType == "" {
+		writeError(w, http.StatusBadRequest, "required", "Required parameter: mimeType")
+		return
+	}
+	if !strings.HasPrefix(file.MimeType, "application/vnd.google-apps.") {
+		writeError(w, http.StatusForbidden, "fileNotExportable", "Export only supports Docs Editors files.")
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeType)
+	w.Write([]byte(file.Content))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Writes an error in the format of Google APIs
+func writeError(w http.ResponseWriter, code int, status, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"status":  status,
+		},
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/mspcix/google-classroom-course-downloader/database"
 	"github.com/mspcix/google-classroom-course-downloader/routes"
+	"github.com/mspcix/google-classroom-course-downloader/services"
 	"github.com/mspcix/google-classroom-course-downloader/utils"
 )
 
@@ -69,6 +71,12 @@ func main() {
 
 	routes.SetupRoutes(r, cookieStore)
 
+	// Jobs cut short by a restart, or by another process stopping, pick up where they stopped
+	go services.WatchInterruptedJobs(context.Background())
+
+	// Archives handed out through presigned links are removed once the links expired
+	go utils.CleanArchives(context.Background(), utils.ContentStorage)
+
 	fmt.Println("Server started at " + os.Getenv("SERVER_URL"))
 
 	log.Fatal(http.ListenAndServe(os.Getenv("SERVER_DOMAIN")+":"+
@@ -1,15 +1,18 @@
 package models
 
 import (
+	"fmt"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/mspcix/google-classroom-course-downloader/utils"
 )
 
 type Course struct {
 	ID                 uint      `gorm:"column:id" json:"cpid"`
-	GCID               string    `gorm:"column:gcid" json:"id"`
+	GCID               string    `gorm:"column:gcid;uniqueIndex" json:"id"`
 	Name               string    `gorm:"column:name" json:"name"`
 	Description        string    `gorm:"column:description" json:"description"`
 	Section            string    `gorm:"column:section" json:"section"`
@@ -25,11 +28,26 @@ type Course struct {
 		Title         string `gorm:"column:teacher_folder_title" json:"title"`
 		AlternateLink string `gorm:"column:teacher_folder_alternate_link" json:"alternateLink"`
 	} `gorm:"embedded;embeddedPrefix:teacher_folder_" json:"teacherFolder"`
-	OwnerID  string `gorm:"column:owner_id" json:"ownerId"`
-	UserGCID string `gorm:"column:user_gcid_f;not null" json:"userId"`
+	OwnerID string `gorm:"column:owner_id" json:"ownerId"`
 
 	Announcements       []Announcement       `json:"announcements"`
 	CourseWorkMaterials []CourseWorkMaterial `json:"courseWorkMaterials"`
+	CourseWork          []CourseWork         `json:"courseWork"`
+	Topics              []Topic              `json:"topics"`
+}
+
+// A topic grouping the course work and materials of a course
+type Topic struct {
+	ID         uint   `gorm:"column:tpid" json:"tpid"`
+	GCID       string `gorm:"column:gcid" json:"topicId"`
+	Name       string `gorm:"column:name" json:"name"`
+	UpdateTime string `gorm:"column:update_time" json:"updateTime"`
+	// Order of the topic in Classroom, starting at 0
+	Position int `gorm:"column:position" json:"position"`
+	// Set when the topic was deleted in Classroom
+	RemovedAt *time.Time `gorm:"column:removed_at" json:"removedAt,omitempty"`
+
+	CourseID string `gorm:"column:course_id_f;not null" json:"courseId"`
 }
 
 type Announcement struct {
@@ -43,6 +61,8 @@ type Announcement struct {
 	ScheduledTime string `gorm:"column:scheduled_time;not null" json:"scheduledTime"`
 	AssigneeMode  string `gorm:"column:assignee_mode;not null" json:"assigneeMode"`
 	CreatorUserId string `gorm:"column:creator_user_id;not null" json:"creatorUserId"`
+	// Set when the announcement was deleted in Classroom
+	RemovedAt *time.Time `gorm:"column:removed_at" json:"removedAt,omitempty"`
 
 	CourseID  string     `gorm:"column:course_id_f;not null" json:"courseId"`
 	Materials []Material `json:"materials"`
@@ -62,11 +82,88 @@ type CourseWorkMaterial struct {
 	// IndividualStudentsOptions IndividualStudentsOptions `gorm:"embedded;embeddedPrefix:std_opts_" json:"individualStudentsOptions"`
 	CreatorUserID string `gorm:"column:creator_user_id" json:"creatorUserId"`
 	TopicID       string `gorm:"column:topic_id" json:"topicId"`
+	// Set when the material was deleted in Classroom
+	RemovedAt *time.Time `gorm:"column:removed_at" json:"removedAt,omitempty"`
 
 	CourseID  string     `gorm:"column:course__id_f;not null" json:"courseId"`
 	Materials []Material `json:"materials"`
 }
 
+// An assignment or a question of a course
+type CourseWork struct {
+	ID            uint   `gorm:"column:cwpid" json:"cwpid"`
+	GCID          string `gorm:"column:gcid" json:"id"`
+	Title         string `gorm:"column:title" json:"title"`
+	Description   string `gorm:"column:description" json:"description"`
+	State         string `gorm:"column:state" json:"state"`
+	AlternateLink string `gorm:"column:alternate_link" json:"alternateLink"`
+	CreationTime  string `gorm:"column:creation_time" json:"creationTime"`
+	UpdateTime    string `gorm:"column:update_time" json:"updateTime"`
+	ScheduledTime string `gorm:"column:scheduled_time" json:"scheduledTime"`
+	DueDate       struct {
+		Year  int `gorm:"column:year" json:"year"`
+		Month int `gorm:"column:month" json:"month"`
+		Day   int `gorm:"column:day" json:"day"`
+	} `gorm:"embedded;embeddedPrefix:due_date_" json:"dueDate"`
+	DueTime struct {
+		Hours   int `gorm:"column:hours" json:"hours"`
+		Minutes int `gorm:"column:minutes" json:"minutes"`
+	} `gorm:"embedded;embeddedPrefix:due_time_" json:"dueTime"`
+	MaxPoints              float64 `gorm:"column:max_points" json:"maxPoints"`
+	WorkType               string  `gorm:"column:work_type" json:"workType"`
+	MultipleChoiceQuestion struct {
+		Choices pq.StringArray `gorm:"column:choices;type:text[]" json:"choices"`
+	} `gorm:"embedded;embeddedPrefix:multiple_choice_" json:"multipleChoiceQuestion"`
+	AssigneeMode  string `gorm:"column:assignee_mode" json:"assigneeMode"`
+	CreatorUserID string `gorm:"column:creator_user_id" json:"creatorUserId"`
+	TopicID       string `gorm:"column:topic_id" json:"topicId"`
+	// Set when the course work was deleted in Classroom
+	RemovedAt *time.Time `gorm:"column:removed_at" json:"removedAt,omitempty"`
+
+	CourseID    string              `gorm:"column:course_id_f;not null" json:"courseId"`
+	Materials   []Material          `json:"materials"`
+	Submissions []StudentSubmission `json:"submissions"`
+}
+
+// A student's submission to a course work
+type StudentSubmission struct {
+	ID             uint     `gorm:"column:sspid" json:"sspid"`
+	GCID           string   `gorm:"column:gcid" json:"id"`
+	CourseWorkGCID string   `gorm:"column:course_work_gcid" json:"courseWorkId"`
+	UserGCID       string   `gorm:"column:user_gcid" json:"userId"`
+	State          string   `gorm:"column:state" json:"state"`
+	Late           bool     `gorm:"column:late" json:"late"`
+	AssignedGrade  *float64 `gorm:"column:assigned_grade" json:"assignedGrade"`
+	DraftGrade     *float64 `gorm:"column:draft_grade" json:"draftGrade"`
+	AlternateLink  string   `gorm:"column:alternate_link" json:"alternateLink"`
+	CreationTime   string   `gorm:"column:creation_time" json:"creationTime"`
+	UpdateTime     string   `gorm:"column:update_time" json:"updateTime"`
+	CourseWorkType string   `gorm:"column:course_work_type" json:"courseWorkType"`
+	// Set when the submission is no longer returned by Classroom
+	RemovedAt *time.Time `gorm:"column:removed_at" json:"removedAt,omitempty"`
+	// Only used to decode the API response, the attachments are stored as Materials
+	AssignmentSubmission struct {
+		Attachments []Attachment `json:"attachments"`
+	} `gorm:"-" json:"assignmentSubmission"`
+
+	CourseWorkID uint       `gorm:"column:course_work_id_f;not null" json:"courseWorkPid"`
+	Materials    []Material `json:"materials"`
+}
+
+// An attachment of a student submission
+// Unlike materials, drive files aren't wrapped in a shared drive file
+type Attachment struct {
+	DriveFile struct {
+		GID           string `json:"id"`
+		Title         string `json:"title"`
+		AlternateLink string `json:"alternateLink"`
+		ThumbnailUrl  string `json:"thumbnailUrl"`
+	} `json:"driveFile"`
+	YoutubeVideo YoutubeVideo `json:"youTubeVideo"`
+	Link         Link         `json:"link"`
+	Form         Form         `json:"form"`
+}
+
 // type IndividualStudentsOptions struct {
 // 	StudentIDs string `gorm:"column:student_ids" json:"studentIds"`
 // }
@@ -84,6 +181,8 @@ type Material struct {
 
 	AnnouncementID       *uint `gorm:"column:announcement_id_f" json:"announcementId"`
 	CourseWorkMaterialID *uint `gorm:"column:courseWorkMaterial_id_f" json:"courseWorkMaterialId"`
+	CourseWorkID         *uint `gorm:"column:course_work_id_f" json:"courseWorkId"`
+	StudentSubmissionID  *uint `gorm:"column:student_submission_id_f" json:"studentSubmissionId"`
 }
 
 type DriveFile struct {
@@ -96,6 +195,13 @@ type DriveFile struct {
 	} `gorm:"embedded;embeddedPrefix:drive_file_" json:"driveFile"`
 	ShareMode string `gorm:"column:drive_file_share_mode" json:"shareMode"`
 
+	// Metadata from Drive, filled when the file is downloaded and used to verify it
+	// Google Workspace files have no checksum nor size
+	MD5Checksum  string     `gorm:"column:md5_checksum" json:"md5Checksum,omitempty"`
+	Size         int64      `gorm:"column:size" json:"size,omitempty"`
+	MimeType     string     `gorm:"column:mime_type" json:"mimeType,omitempty"`
+	ModifiedTime *time.Time `gorm:"column:modified_time" json:"modifiedTime,omitempty"`
+
 	MaterialID string `gorm:"column:material_id_f;not null"`
 }
 
@@ -128,6 +234,21 @@ type Form struct {
 	MaterialID string `gorm:"column:material_id_f;not null"`
 }
 
+// Convert a submission attachment to a material
+func (a *Attachment) ToMaterial() Material {
+	material := Material{
+		YoutubeVideo: a.YoutubeVideo,
+		Link:         a.Link,
+		Form:         a.Form,
+	}
+	material.DriveFile.DriveFile.GID = a.DriveFile.GID
+	material.DriveFile.DriveFile.Title = a.DriveFile.Title
+	material.DriveFile.DriveFile.AlternateLink = a.DriveFile.AlternateLink
+	material.DriveFile.DriveFile.ThumbnailUrl = a.DriveFile.ThumbnailUrl
+	material.SetTitleTypeURL()
+	return material
+}
+
 // Set the URL, Type and Title of a material
 func (m *Material) SetTitleTypeURL() {
 	switch {
@@ -160,32 +281,178 @@ func (c *Course) AddCourseWorkMaterial(courseWorkMaterial *CourseWorkMaterial) {
 	c.CourseWorkMaterials = append(c.CourseWorkMaterials, *courseWorkMaterial)
 }
 
+// Add a course work to a course
+func (c *Course) AddCourseWork(courseWork *CourseWork) {
+	c.CourseWork = append(c.CourseWork, *courseWork)
+}
+
+// Returns the due date of a course work, or false if it has none
+// Classroom due dates and times are in UTC
+func (cw *CourseWork) Due() (time.Time, bool) {
+	if cw.DueDate.Year == 0 {
+		return time.Time{}, false
+	}
+	return time.Date(cw.DueDate.Year, time.Month(cw.DueDate.Month), cw.DueDate.Day,
+		cw.DueTime.Hours, cw.DueTime.Minutes, 0, 0, time.UTC), true
+}
+
+// Returns a human readable summary of the course work's type, due date, points and choices
+func (cw *CourseWork) DetailsText() string {
+	var details strings.Builder
+
+	fmt.Fprintf(&details, "Title: %s\n", cw.Title)
+	fmt.Fprintf(&details, "Work type: %s\n", cw.WorkType)
+	if due, ok := cw.Due(); ok {
+		fmt.Fprintf(&details, "Due: %s\n", due.Format("2006-01-02 15:04 MST"))
+	} else {
+		details.WriteString("Due: no due date\n")
+	}
+	if cw.MaxPoints > 0 {
+		fmt.Fprintf(&details, "Max points: %g\n", cw.MaxPoints)
+	} else {
+		details.WriteString("Max points: ungraded\n")
+	}
+	if len(cw.MultipleChoiceQuestion.Choices) > 0 {
+		details.WriteString("Choices:\n")
+		for _, choice := range cw.MultipleChoiceQuestion.Choices {
+			fmt.Fprintf(&details, "  - %s\n", choice)
+		}
+	}
+	fmt.Fprintf(&details, "Link: %s\n", cw.AlternateLink)
+
+	return details.String()
+}
+
+// Returns a human readable summary of the submission's state and grade
+func (s *StudentSubmission) DetailsText() string {
+	var details strings.Builder
+
+	fmt.Fprintf(&details, "State: %s\n", s.State)
+	if s.Late {
+		details.WriteString("Late: yes\n")
+	}
+	switch {
+	case s.AssignedGrade != nil:
+		fmt.Fprintf(&details, "Grade: %g\n", *s.AssignedGrade)
+	case s.DraftGrade != nil:
+		fmt.Fprintf(&details, "Draft grade: %g\n", *s.DraftGrade)
+	default:
+		details.WriteString("Grade: not graded\n")
+	}
+	fmt.Fprintf(&details, "Last update: %s\n", s.UpdateTime)
+	fmt.Fprintf(&details, "Link: %s\n", s.AlternateLink)
+
+	return details.String()
+}
+
 type DownloadItem struct {
+	CourseID           string     `json:"courseId"`
+	CourseName         string     `json:"courseName"`
+	Title              string     `json:"title"`
 	DownloadFolderPath string     `gorm:"column:material_download_path" json:"downloadFolderPath"`
 	Text               string     `gorm:"column:material_text" json:"text"`
+	Details            string     `json:"details"`
 	ItemType           string     `gorm:"column:item_type" json:"itemType"`
+	ItemID             uint       `json:"itemId"`     // Database ID of the announcement, material, course work or submission
+	UpdateTime         string     `json:"updateTime"` // Classroom's last update of the item, used as the files' modification time
 	Materials          []Material `json:"materials"`
+
+	FileNames map[uint]string `gorm:"-" json:"-"` // Name of the file of each Drive file material, set by JobDownloadItems
+}
+
+// Returns the items to download for courses, each course in its own folder, following the given layout
+// Folder and file names are made safe and unique, paths are relative to the job's folder
+func JobDownloadItems(courses []Course, layout string) []DownloadItem {
+	var downloadItems []DownloadItem
+	courseFolders := utils.NewUniquePaths()
+	for i := range courses {
+		name := utils.SafeName(courses[i].Name)
+		if name == "" {
+			name = utils.SafeName(courses[i].GCID)
+		}
+		courseFolder := courseFolders.Unique(name, true)
+		downloadItems = append(downloadItems, courses[i].GetDownloadItems(courseFolder, layout)...)
+	}
+
+	assignFileNames(downloadItems)
+	return downloadItems
 }
 
-func (c *Course) GetDownloadItems() []DownloadItem {
+// Returns the items to download for a course, laid out under courseFolder
+// following the given layout (LayoutTopic or LayoutDate)
+func (c *Course) GetDownloadItems(courseFolder, layout string) []DownloadItem {
 	var downloadItems []DownloadItem
+	folders := newItemFolders(c, courseFolder, layout)
 
 	for _, cwMaterial := range c.CourseWorkMaterials {
+		if cwMaterial.RemovedAt != nil {
+			continue
+		}
 		downloadItem := DownloadItem{
+			CourseID:           c.GCID,
+			CourseName:         c.Name,
+			Title:              cwMaterial.Title,
 			ItemType:           "courseWorkMaterial",
+			ItemID:             cwMaterial.ID,
 			Materials:          append([]Material{}, cwMaterial.Materials...), // Create a new slice
 			Text:               cwMaterial.Description,
-			DownloadFolderPath: filepath.Join(utils.DownloadFolderPath, c.Name, utils.MakeFolderNameFromTime(cwMaterial.CreationTime)),
+			UpdateTime:         cwMaterial.UpdateTime,
+			DownloadFolderPath: folders.forItem(cwMaterial.TopicID, cwMaterial.Title, cwMaterial.CreationTime),
+		}
+		downloadItems = append(downloadItems, downloadItem)
+	}
+
+	for _, courseWork := range c.CourseWork {
+		if courseWork.RemovedAt != nil {
+			continue
+		}
+		downloadItem := DownloadItem{
+			CourseID:           c.GCID,
+			CourseName:         c.Name,
+			Title:              courseWork.Title,
+			ItemType:           "courseWork",
+			ItemID:             courseWork.ID,
+			Materials:          append([]Material{}, courseWork.Materials...), // Create a new slice
+			Text:               courseWork.Description,
+			Details:            courseWork.DetailsText(),
+			UpdateTime:         courseWork.UpdateTime,
+			DownloadFolderPath: folders.forCourseWork(courseWork.TopicID, courseWork.Title, courseWork.CreationTime),
 		}
 		downloadItems = append(downloadItems, downloadItem)
+
+		// The user's own submissions are saved next to the assignment
+		for _, submission := range courseWork.Submissions {
+			if submission.RemovedAt != nil {
+				continue
+			}
+			downloadItems = append(downloadItems, DownloadItem{
+				CourseID:           c.GCID,
+				CourseName:         c.Name,
+				Title:              courseWork.Title + " (My Submission)",
+				ItemType:           "studentSubmission",
+				ItemID:             submission.ID,
+				Materials:          append([]Material{}, submission.Materials...), // Create a new slice
+				Details:            submission.DetailsText(),
+				UpdateTime:         submission.UpdateTime,
+				DownloadFolderPath: filepath.Join(downloadItem.DownloadFolderPath, "My Submission"),
+			})
+		}
 	}
 
 	for _, announcement := range c.Announcements {
+		if announcement.RemovedAt != nil {
+			continue
+		}
 		downloadItem := DownloadItem{
+			CourseID:           c.GCID,
+			CourseName:         c.Name,
+			Title:              "Announcement " + utils.MakeFolderNameFromTime(announcement.CreationTime),
 			ItemType:           "announcement",
+			ItemID:             announcement.ID,
 			Materials:          append([]Material{}, announcement.Materials...), // Create a new slice
 			Text:               announcement.Text,
-			DownloadFolderPath: filepath.Join(utils.DownloadFolderPath, c.Name, utils.MakeFolderNameFromTime(announcement.CreationTime)),
+			UpdateTime:         announcement.UpdateTime,
+			DownloadFolderPath: folders.forAnnouncement(announcement.CreationTime),
 		}
 		downloadItems = append(downloadItems, downloadItem)
 	}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+const (
+	// Course/Topic/Item title/
+	LayoutTopic = "topic"
+	// Course/Creation date/, course work in Course/Creation date/Item title/
+	LayoutDate = "date"
+)
+
+const (
+	noTopicFolder       = "No topic"
+	announcementsFolder = "Announcements"
+	untitledFile        = "Untitled"
+)
+
+// Files written next to the materials of an item, which no material may take the name of
+var itemTextFiles = []string{"Announcement.txt", "Details.txt", "links.txt"}
+
+// Reports whether a layout name is supported
+func IsValidLayout(layout string) bool {
+	return layout == LayoutTopic || layout == LayoutDate
+}
+
+// Builds the folders of a course's download items according to a layout
+type itemFolders struct {
+	coursePath   string
+	layout       string
+	topicFolders map[string]string
+	usedFolders  *utils.UniquePaths
+}
+
+func newItemFolders(c *Course, coursePath, layout string) *itemFolders {
+	folders := &itemFolders{
+		coursePath:   coursePath,
+		layout:       layout,
+		topicFolders: make(map[string]string),
+		usedFolders:  utils.NewUniquePaths(),
+	}
+
+	// Number the topic folders so they sort in the same order as in Classroom
+	var topics []Topic
+	for _, topic := range c.Topics {
+		if topic.RemovedAt == nil {
+			topics = append(topics, topic)
+		}
+	}
+	sort.SliceStable(topics, func(i, j int) bool { return topics[i].Position < topics[j].Position })
+	for i, topic := range topics {
+		folders.topicFolders[topic.GCID] = utils.SafeName(fmt.Sprintf("%02d - %s", i+1, topic.Name))
+	}
+
+	return folders
+}
+
+// Returns the folder of a course work material
+func (f *itemFolders) forItem(topicID, title, creationTime string) string {
+	if f.layout == LayoutDate {
+		return filepath.Join(f.coursePath, utils.MakeFolderNameFromTime(creationTime))
+	}
+
+	topicFolder, ok := f.topicFolders[topicID]
+	if !ok {
+		topicFolder = noTopicFolder
+	}
+	return f.titled(filepath.Join(f.coursePath, topicFolder), title, creationTime)
+}
+
+// Returns the folder of a course work
+// Course work always has a folder of its own, its details and the user's submission
+// would otherwise overwrite those of the course work created the same day
+func (f *itemFolders) forCourseWork(topicID, title, creationTime string) string {
+	if f.layout == LayoutDate {
+		return f.titled(filepath.Join(f.coursePath, utils.MakeFolderNameFromTime(creationTime)), title, creationTime)
+	}
+	return f.forItem(topicID, title, creationTime)
+}
+
+// Returns a unique folder named after the item's title in parent, or after its creation time if it has none
+func (f *itemFolders) titled(parent, title, creationTime string) string {
+	name := utils.SafeName(title)
+	if name == "" {
+		name = utils.MakeFolderNameFromTime(creationTime)
+	}
+	return f.unique(filepath.Join(parent, name))
+}
+
+// Returns the folder of an announcement
+// Announcements have no title nor topic, those of the same day share a folder
+func (f *itemFolders) forAnnouncement(creationTime string) string {
+	if f.layout == LayoutDate {
+		return filepath.Join(f.coursePath, utils.MakeFolderNameFromTime(creationTime))
+	}
+	return filepath.Join(f.coursePath, announcementsFolder, utils.MakeFolderNameFromTime(creationTime))
+}
+
+// Suffixes the folder with a counter if another item already uses it
+func (f *itemFolders) unique(folder string) string {
+	return f.usedFolders.Unique(folder, true)
+}
+
+// Names the file of each Drive file material so that no two files of a folder share a name,
+// nor take the name of a subfolder or of the item's text files
+// Items sharing a folder are named in order, so the names are the same each time the items are built
+func assignFileNames(items []DownloadItem) {
+	used := utils.NewUniquePaths()
+	for _, item := range items {
+		for folder := item.DownloadFolderPath; folder != "." && folder != string(filepath.Separator); folder = filepath.Dir(folder) {
+			used.Reserve(folder)
+		}
+		for _, name := range itemTextFiles {
+			used.Reserve(filepath.Join(item.DownloadFolderPath, name))
+		}
+	}
+
+	for i := range items {
+		items[i].FileNames = make(map[uint]string)
+		for _, material := range items[i].Materials {
+			if material.Type != "driveFile" {
+				continue
+			}
+			name := utils.SafeName(material.Title)
+			if name == "" {
+				name = untitledFile
+			}
+			// Named with their export extension, so an exported Doc and a PDF of the same title don't collide
+			name = utils.ExportedName(name, material.DriveFile.MimeType, material.DriveFile.DriveFile.AlternateLink)
+			filePath := used.Unique(filepath.Join(items[i].DownloadFolderPath, name), false)
+			items[i].FileNames[material.ID] = filepath.Base(filePath)
+		}
+	}
+}
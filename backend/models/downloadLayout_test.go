@@ -0,0 +1,46 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+func driveFileMaterial(id uint, title, mimeType, link string) Material {
+	material := Material{ID: id, Title: title, Type: "driveFile"}
+	material.DriveFile.MimeType = mimeType
+	material.DriveFile.DriveFile.AlternateLink = link
+	return material
+}
+
+// Exported files are de-duplicated under the name they are saved with, extension included
+func TestAssignFileNamesWithExportExtensions(t *testing.T) {
+	if err := utils.InitExportFormats(); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []DownloadItem{{
+		DownloadFolderPath: "Course/Item",
+		Materials: []Material{
+			driveFileMaterial(1, "Report.pdf", "", "https://drive.google.com/file/d/report-pdf"),
+			driveFileMaterial(2, "Report", "", "https://docs.google.com/document/d/report-doc/edit"),
+			driveFileMaterial(3, "Report", "application/vnd.google-apps.document", ""),
+			driveFileMaterial(4, "Budget", "", "https://docs.google.com/spreadsheets/d/budget"),
+			driveFileMaterial(5, "Notes", "", "https://drive.google.com/file/d/notes"),
+		},
+	}}
+	assignFileNames(items)
+
+	want := map[uint]string{
+		1: "Report.pdf",
+		2: "Report (2).pdf",
+		3: "Report (3).pdf",
+		4: "Budget.xlsx",
+		5: "Notes",
+	}
+	for id, name := range want {
+		if got := items[0].FileNames[id]; got != name {
+			t.Errorf("material %d named %q, want %q", id, got, name)
+		}
+	}
+}
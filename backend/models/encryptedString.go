@@ -0,0 +1,37 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+// A string encrypted when written to the database and decrypted when read back
+// Encrypted columns can't be used in queries, look rows up by another column
+type EncryptedString string
+
+func (s EncryptedString) Value() (driver.Value, error) {
+	return utils.EncryptToken(string(s))
+}
+
+func (s *EncryptedString) Scan(value interface{}) error {
+	var stored string
+	switch v := value.(type) {
+	case nil:
+		stored = ""
+	case string:
+		stored = v
+	case []byte:
+		stored = string(v)
+	default:
+		return fmt.Errorf("unsupported type %T for an encrypted string", value)
+	}
+
+	decrypted, err := utils.DecryptToken(stored)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(decrypted)
+	return nil
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued  JobStatus = "queued"
+	JobStatusRunning JobStatus = "running"
+	JobStatusDone    JobStatus = "done"
+	JobStatusFailed  JobStatus = "failed"
+	// Finished, but some materials couldn't be saved. The job can be served, and resumed to retry them.
+	JobStatusPartial JobStatus = "partial"
+)
+
+// A download job started by a user for a list of courses
+type Job struct {
+	ID         string         `gorm:"column:id;primaryKey" json:"id"`
+	UserGCID   string         `gorm:"column:user_gcid_f;not null;index" json:"-"`
+	CoursesIDs pq.StringArray `gorm:"column:courses_ids;type:text[]" json:"coursesIds"`
+	Layout     string         `gorm:"column:layout" json:"layout"`
+	Status     JobStatus      `gorm:"column:status;not null" json:"status"`
+	Error      string         `gorm:"column:error" json:"error,omitempty"`
+	CreatedAt  time.Time      `gorm:"column:created_at" json:"createdAt"`
+	StartedAt  *time.Time     `gorm:"column:started_at" json:"startedAt,omitempty"`
+	FinishedAt *time.Time     `gorm:"column:finished_at" json:"finishedAt,omitempty"`
+
+	// Process running the job, and until when. Another process may only take the job over once the lease expired.
+	Owner          string     `gorm:"column:owner" json:"-"`
+	LeaseExpiresAt *time.Time `gorm:"column:lease_expires_at" json:"-"`
+}
+
+// Reports whether the job won't change status anymore
+func (j *Job) IsFinished() bool {
+	return j.Status == JobStatusDone || j.Status == JobStatusFailed || j.Status == JobStatusPartial
+}
+
+// Reports whether the job's files can be served
+func (j *Job) IsServable() bool {
+	return j.Status == JobStatusDone || j.Status == JobStatusPartial
+}
+
+type ProgressEventType string
+
+const (
+	ProgressSnapshot         ProgressEventType = "snapshot"
+	ProgressJobStarted       ProgressEventType = "jobStarted"
+	ProgressItemStarted      ProgressEventType = "itemStarted"
+	ProgressBytesWritten     ProgressEventType = "bytesWritten"
+	ProgressMaterialFinished ProgressEventType = "materialFinished"
+	ProgressMaterialFailed   ProgressEventType = "materialFailed"
+	ProgressCourseFinished   ProgressEventType = "courseFinished"
+	ProgressJobFinished      ProgressEventType = "jobFinished"
+)
+
+// An update on a running job, streamed to the client.
+// The counters always hold the totals of the job at the time of the event.
+type ProgressEvent struct {
+	Type       ProgressEventType `json:"type"`
+	JobID      string            `json:"jobId"`
+	CourseID   string            `json:"courseId,omitempty"`
+	CourseName string            `json:"courseName,omitempty"`
+	Item       string            `json:"item,omitempty"`
+	Material   string            `json:"material,omitempty"`
+	Status     JobStatus         `json:"status,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	TotalItems    int   `json:"totalItems"`
+	FinishedItems int   `json:"finishedItems"`
+	BytesWritten  int64 `json:"bytesWritten"`
+}
+
+type MaterialDownloadStatus string
+
+const (
+	MaterialDownloadPending MaterialDownloadStatus = "pending"
+	MaterialDownloadDone    MaterialDownloadStatus = "done"
+	MaterialDownloadFailed  MaterialDownloadStatus = "failed"
+)
+
+// What a download state entry is about: a material, or the text or details file of an item
+// The kind of an item file is its item type followed by its part, e.g. "announcementText"
+const MaterialDownloadKindMaterial = "material"
+
+const (
+	ItemFileText    = "Text"
+	ItemFileDetails = "Details"
+)
+
+// Where the download of a material stands within a job, so a resumed job can skip or continue it
+// Text and details files of items are recorded the same way, MaterialID then being the item's ID
+type MaterialDownload struct {
+	JobID        string                 `gorm:"column:job_id_f;primaryKey" json:"-"`
+	Kind         string                 `gorm:"column:kind;primaryKey" json:"kind"`
+	MaterialID   uint                   `gorm:"column:material_id_f;primaryKey;autoIncrement:false" json:"materialId"`
+	Title        string                 `gorm:"column:title" json:"title"`
+	Status       MaterialDownloadStatus `gorm:"column:status;not null" json:"status"`
+	FilePath     string                 `gorm:"column:file_path" json:"filePath"`
+	BytesWritten int64                  `gorm:"column:bytes_written" json:"bytesWritten"`
+	Checksum     string                 `gorm:"column:checksum" json:"checksum,omitempty"` // MD5 of the file, in hex
+	Error        string                 `gorm:"column:error" json:"error,omitempty"`
+	UpdatedAt    time.Time              `gorm:"column:updated_at" json:"updatedAt"`
+}
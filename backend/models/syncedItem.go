@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// Course content synced incrementally with Classroom.
+// Items are matched by their Classroom ID and updated when their update time changes.
+type SyncedItem interface {
+	GetID() uint
+	GetGCID() string
+	GetUpdateTime() string
+	GetRemovedAt() *time.Time
+	GetMaterials() []Material
+}
+
+func (a *Announcement) GetID() uint              { return a.ID }
+func (a *Announcement) GetGCID() string          { return a.GCID }
+func (a *Announcement) GetUpdateTime() string    { return a.UpdateTime }
+func (a *Announcement) GetRemovedAt() *time.Time { return a.RemovedAt }
+func (a *Announcement) GetMaterials() []Material { return a.Materials }
+
+func (cwm *CourseWorkMaterial) GetID() uint              { return cwm.ID }
+func (cwm *CourseWorkMaterial) GetGCID() string          { return cwm.GCID }
+func (cwm *CourseWorkMaterial) GetUpdateTime() string    { return cwm.UpdateTime }
+func (cwm *CourseWorkMaterial) GetRemovedAt() *time.Time { return cwm.RemovedAt }
+func (cwm *CourseWorkMaterial) GetMaterials() []Material { return cwm.Materials }
+
+func (cw *CourseWork) GetID() uint              { return cw.ID }
+func (cw *CourseWork) GetGCID() string          { return cw.GCID }
+func (cw *CourseWork) GetUpdateTime() string    { return cw.UpdateTime }
+func (cw *CourseWork) GetRemovedAt() *time.Time { return cw.RemovedAt }
+func (cw *CourseWork) GetMaterials() []Material { return cw.Materials }
+
+func (s *StudentSubmission) GetID() uint              { return s.ID }
+func (s *StudentSubmission) GetGCID() string          { return s.GCID }
+func (s *StudentSubmission) GetUpdateTime() string    { return s.UpdateTime }
+func (s *StudentSubmission) GetRemovedAt() *time.Time { return s.RemovedAt }
+func (s *StudentSubmission) GetMaterials() []Material { return s.Materials }
+
+func (t *Topic) GetID() uint              { return t.ID }
+func (t *Topic) GetGCID() string          { return t.GCID }
+func (t *Topic) GetUpdateTime() string    { return t.UpdateTime }
+func (t *Topic) GetRemovedAt() *time.Time { return t.RemovedAt }
+func (t *Topic) GetMaterials() []Material { return nil }
@@ -21,13 +21,34 @@ type GCProfile struct {
 type User struct {
 	gorm.Model
 
-	GCUID        string    `gorm:"column:gc_user_id;not null;uniqueIndex"` // Google Classroom user ID
-	Username     string    `gorm:"column:username;not null"`
-	Email        string    `gorm:"column:email;not null"`
-	Token        string    `gorm:"column:token;not null"`
-	TokenExpiry  time.Time `gorm:"column:token_expiry;not null"`
-	RefreshToken string    `gorm:"column:refresh_token; not null"`
-	PhotoUrl     string    `gorm:"column:photo_url;not null"`
-
-	Courses []Course `gorm:"foreignKey:UserGCID;references:GCUID"`
+	GCUID        string          `gorm:"column:gc_user_id;not null;uniqueIndex"` // Google Classroom user ID
+	Username     string          `gorm:"column:username;not null"`
+	Email        string          `gorm:"column:email;not null"`
+	Token        EncryptedString `gorm:"column:token;type:text;not null"`
+	TokenExpiry  time.Time       `gorm:"column:token_expiry;not null"`
+	RefreshToken EncryptedString `gorm:"column:refresh_token;type:text;not null"`
+	PhotoUrl     string          `gorm:"column:photo_url;not null"`
+}
+
+// Links a user to a course they are enrolled in
+// Courses and their content are stored once and shared by every enrolled user
+type Enrollment struct {
+	UserGCID   string    `gorm:"column:user_gcid;primaryKey"`
+	CourseGCID string    `gorm:"column:course_gcid;primaryKey;index"`
+	CreatedAt  time.Time `gorm:"column:created_at"`
+}
+
+// Kinds of course content whose visibility is tracked per user
+const (
+	ItemTypeAnnouncement       = "announcement"
+	ItemTypeCourseWorkMaterial = "courseWorkMaterial"
+	ItemTypeCourseWork         = "courseWork"
+)
+
+// Records that Classroom returned an item of a course to a user
+// Items can be assigned to some students only, so a user's syncs only show and remove what they see
+type ItemVisibility struct {
+	UserGCID string `gorm:"column:user_gcid;primaryKey"`
+	ItemType string `gorm:"column:item_type;primaryKey"`
+	ItemID   uint   `gorm:"column:item_id;primaryKey;autoIncrement:false;index"`
 }
@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+)
+
+// Body of the response sent when a user requests courses they aren't enrolled in
+type forbiddenCoursesResponse struct {
+	Error              string   `json:"error"`
+	Message            string   `json:"message"`
+	ForbiddenCourseIDs []string `json:"forbiddenCourseIDs"`
+}
+
+// Checks that the user is enrolled in every requested course
+// Writes a 403 response listing the other courses and returns false otherwise
+func authorizeCourses(w http.ResponseWriter, gcuid string, coursesIDs []string) bool {
+	forbiddenCoursesIDs, err := database.GetNotEnrolledCoursesGCIDs(gcuid, coursesIDs)
+	if err != nil {
+		log.Println("Error checking course enrollments:", err)
+		http.Error(w, "Failed to check course access", http.StatusInternalServerError)
+		return false
+	}
+
+	if len(forbiddenCoursesIDs) == 0 {
+		return true
+	}
+
+	log.Printf("User %s requested %d course(s) they aren't enrolled in: %v", gcuid, len(forbiddenCoursesIDs), forbiddenCoursesIDs)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(forbiddenCoursesResponse{
+		Error:              "forbidden",
+		Message:            "You are not enrolled in some of the requested courses",
+		ForbiddenCourseIDs: forbiddenCoursesIDs,
+	})
+	return false
+}
@@ -1,7 +1,9 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,92 +11,47 @@ import (
 	"os"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 	"github.com/mspcix/google-classroom-course-downloader/database"
 	"github.com/mspcix/google-classroom-course-downloader/models"
 	"github.com/mspcix/google-classroom-course-downloader/services"
+	"github.com/mspcix/google-classroom-course-downloader/storage"
 
 	"github.com/mspcix/google-classroom-course-downloader/utils"
 )
 
 // Retrieves the list of new courses for the authenticated user from Google's Classroom API
-// Inserts them into the database
+// Inserts them into the database and enrolls the user in every course
+// Courses already in the database are synced when the user joins them, or for every course with ?sync=true
+// The courses can be filtered with ?courseStates=ACTIVE,ARCHIVED&studentId=me or teacherId=me
 func HandleDiscoverCourses(w http.ResponseWriter, r *http.Request, store sessions.Store) {
 	startDiscovery := time.Now()
 	log.Println("[HandleDiscoverCourses] hit")
-	token, err := database.GetTokenFromSession(r, store)
-	if err != nil {
-		log.Println("Error retrieving token from the database:", err)
-		return
-	}
-
-	courses, err := services.GetCoursesFromAPI(r, token)
-	if err != nil {
-		fmt.Println("Error retrieving courses:", err)
-		http.Error(w, "Failed to retrieve courses", http.StatusInternalServerError)
-		return
-	}
-
-	newCourses, err := services.FilterNewCourses(courses)
-	if err != nil {
-		fmt.Println("Error retrieving coursesId from the database:", err)
-		http.Error(w, "Failed to filter new courses", http.StatusInternalServerError)
+	gcuid, err := utils.GetGCUIDFromSession(r, store)
+	if err != nil || gcuid == "" {
+		log.Println("Error retrieving gcuid from the session:", err)
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	newCoursesIDs := make([]string, len(newCourses))
-	for i, course := range newCourses {
-		newCoursesIDs[i] = course.GCID
-	}
-
-	announcements, err := services.GetAnnouncements(r, token, newCoursesIDs)
+	filter, err := services.ParseCourseFilter(r.URL.Query())
 	if err != nil {
-		fmt.Println("Error retrieving announcements:", err)
-		http.Error(w, "Failed to retrieve announcements", http.StatusInternalServerError)
+		log.Println("Invalid course filter:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	courseWorkMaterials, err := services.GetCourseWorkMaterials(r, token, newCoursesIDs)
+	sync := r.URL.Query().Get("sync") == "true"
+	result, err := services.DiscoverCourses(r.Context(), gcuid, filter, sync)
 	if err != nil {
-		fmt.Println("Error retrieving course work materials:", err)
-		http.Error(w, "Failed to retrieve course work materials", http.StatusInternalServerError)
+		fmt.Println("Error discovering courses:", err)
+		http.Error(w, "Failed to discover courses", http.StatusInternalServerError)
 		return
 	}
 
-	// Create maps to store announcements and course work materials by course ID
-	announcementsMap := make(map[string][]models.Announcement)
-	for _, announcement := range announcements {
-		announcementsMap[announcement.CourseID] = append(announcementsMap[announcement.CourseID], announcement)
-	}
-	courseWorkMaterialsMap := make(map[string][]models.CourseWorkMaterial)
-	for _, courseWorkMaterial := range courseWorkMaterials {
-		courseWorkMaterialsMap[courseWorkMaterial.CourseID] = append(courseWorkMaterialsMap[courseWorkMaterial.CourseID], courseWorkMaterial)
-	}
-
-	// Sets the announcements and courseWorkMaterials of all courses
-	for i, course := range newCourses {
-		newCourses[i].Announcements = announcementsMap[course.GCID]
-		newCourses[i].CourseWorkMaterials = courseWorkMaterialsMap[course.GCID]
-	}
-
-	if len(newCourses) != 0 {
-		log.Println("Inserting new courses into the database...")
-		start := time.Now()
-		err = database.SaveCourses(newCourses)
-		if err != nil {
-			fmt.Println("Error inserting courses into the database:", err)
-
-			http.Error(w, "Failed to insert courses into the database", http.StatusInternalServerError)
-			return
-		}
-		elapsed := time.Since(start)
-		log.Printf("Courses successfully inserted into the database in %v", elapsed)
-	} else {
-		log.Println("No new courses to insert into the database")
-	}
-
 	elapsedDiscovery := time.Since(startDiscovery)
-	log.Printf("%v new courses discovered successfully in %v", len(newCourses), elapsedDiscovery)
+	log.Printf("%v new courses discovered successfully in %v", result.New, elapsedDiscovery)
 
 	http.Redirect(w, r, os.Getenv("FRONTEND_COURSES_URL"), http.StatusSeeOther)
 }
@@ -129,84 +86,329 @@ func HandleListCourses(w http.ResponseWriter, r *http.Request, store sessions.St
 }
 
 // Handles request to initiate material download
+// Starts a download job and sends its ID to the client
 func HandleDownloadCourses(w http.ResponseWriter, r *http.Request, store sessions.Store) {
-	startDownload := time.Now()
 	log.Println("[HandleDownloadCourses] hit")
 	// Parse the request body to get selected courses
 	var requestBody struct {
 		SelectedCourses []string `json:"selectedCoursesIDs"`
+		Layout          string   `json:"layout"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
 		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
 		return
 	}
 
-	token, err := database.GetTokenFromSession(r, store)
-	if err != nil || token == "" {
-		log.Println("Error retrieving token from the database:", err)
+	// Folder layout of the download, defaults to the server's
+	layout := requestBody.Layout
+	if layout == "" {
+		layout = os.Getenv("DOWNLOAD_LAYOUT")
+	}
+	if layout == "" {
+		layout = models.LayoutTopic
+	}
+	if !models.IsValidLayout(layout) {
+		http.Error(w, "Unsupported layout "+layout, http.StatusBadRequest)
+		return
+	}
+
+	gcuid, err := utils.GetGCUIDFromSession(r, store)
+	if err != nil || gcuid == "" {
+		log.Println("Error retrieving gcuid from the session:", err)
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	err = services.DownloadCourses(requestBody.SelectedCourses, &token)
+	if len(requestBody.SelectedCourses) == 0 {
+		http.Error(w, "No course selected", http.StatusBadRequest)
+		return
+	}
+
+	// Users can only download the courses they are enrolled in
+	if !authorizeCourses(w, gcuid, requestBody.SelectedCourses) {
+		return
+	}
+
+	job, err := services.StartDownloadJob(gcuid, requestBody.SelectedCourses, layout)
 	if err != nil {
-		log.Printf("Error during download: %v\n", err)
+		log.Println("Error starting download job:", err)
+		http.Error(w, "Failed to start download job", http.StatusInternalServerError)
+		return
 	}
+	log.Printf("Download job %s queued for %v course(s)", job.ID, len(requestBody.SelectedCourses))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"jobId": job.ID})
+}
 
-	elapsedDownload := time.Since(startDownload)
-	log.Printf("%v course(s) successfully downloaded in %v", len(requestBody.SelectedCourses), elapsedDownload)
+// Sends the status of a download job to the client as JSON
+func HandleJobStatus(w http.ResponseWriter, r *http.Request, store sessions.Store) {
+	job, ok := getUserJob(w, r, store)
+	if !ok {
+		return
+	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
 }
 
-// Serves the downloaded courses to the client
-// Deletes local folders
-func HandleServeCourses(w http.ResponseWriter, r *http.Request) {
-	startServe := time.Now()
-	log.Println("[HandleServeCourses] hit")
-	// Remove the folder that was zipped
-	defer os.RemoveAll(utils.DownloadFolderPath)
-	// Remove the zip file
-	defer os.Remove(utils.ZipFilePath)
+// Streams the progress of a download job to the client as Server-Sent Events
+// The stream ends once the job is done or failed
+// A job run by another process only gets its recorded status, the client then polls it
+func HandleJobEvents(w http.ResponseWriter, r *http.Request, store sessions.Store) {
+	log.Println("[HandleJobEvents] hit")
+	job, ok := getUserJob(w, r, store)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent := func(event models.ProgressEvent) {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Println("Error marshaling progress event to JSON:", err)
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	// The job may have finished before the client subscribed
+	if job.IsFinished() {
+		writeEvent(models.ProgressEvent{Type: models.ProgressJobFinished, JobID: job.ID, Status: job.Status, Error: job.Error})
+		return
+	}
 
-	// Check if the folder to zip is empty
-	if isEmpty, err := utils.IsEmptyFolder(utils.DownloadFolderPath); isEmpty || err != nil {
-		http.Error(w, "Course Folder is empty.", http.StatusInternalServerError)
-		log.Printf("Error checking if folder is empty: %v\n", err)
+	events, unsubscribe, ok := services.SubscribeJobProgress(job.ID)
+	if !ok {
+		writeEvent(models.ProgressEvent{Type: models.ProgressSnapshot, JobID: job.ID, Status: job.Status, Error: job.Error})
 		return
 	}
+	defer unsubscribe()
 
-	// Create a zip file of the download folder
-	err := utils.ZipFolder(utils.DownloadFolderPath)
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			writeEvent(event)
+		}
+	}
+}
+
+// Sends the outcome of a job's materials to the client as JSON, listing the ones that failed
+func HandleJobReport(w http.ResponseWriter, r *http.Request, store sessions.Store) {
+	job, ok := getUserJob(w, r, store)
+	if !ok {
+		return
+	}
+
+	report, err := services.GetJobReport(*job)
+	if err != nil {
+		log.Println("Error building job report:", err)
+		http.Error(w, "Failed to build job report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Runs a failed, partial or interrupted download job again, keeping the materials it already saved
+func HandleResumeJob(w http.ResponseWriter, r *http.Request, store sessions.Store) {
+	log.Println("[HandleResumeJob] hit")
+	job, ok := getUserJob(w, r, store)
+	if !ok {
+		return
+	}
+	if job.Status == models.JobStatusDone {
+		http.Error(w, "Job is already done", http.StatusConflict)
+		return
+	}
+
+	if err := services.ResumeDownloadJob(*job); err != nil {
+		if errors.Is(err, services.ErrJobActive) {
+			http.Error(w, "Job is already queued or running", http.StatusConflict)
+			return
+		}
+		log.Println("Error resuming download job:", err)
+		http.Error(w, "Failed to resume download job", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Download job %s resumed", job.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"jobId": job.ID})
+}
+
+// Writes the archive of the files under keyPrefix to storage as it is built
+func storeArchive(ctx context.Context, archiver utils.Archiver, keyPrefix, archiveKey string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archiver.Archive(ctx, pw, utils.ContentStorage, keyPrefix))
+	}()
+	err := utils.ContentStorage.Put(ctx, archiveKey, pr, -1, time.Now())
+	pr.CloseWithError(err)
+	return err
+}
+
+// Retrieves the job from the route variables
+// Writes an error response and returns false if it doesn't belong to the session's user
+func getUserJob(w http.ResponseWriter, r *http.Request, store sessions.Store) (*models.Job, bool) {
+	gcuid, err := utils.GetGCUIDFromSession(r, store)
+	if err != nil || gcuid == "" {
+		log.Println("Error retrieving gcuid from the session:", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	job, err := database.GetJobByID(mux.Vars(r)["jobID"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println("Error retrieving job from the database:", err)
+		http.Error(w, "Failed to retrieve job", http.StatusInternalServerError)
+		return nil, false
+	}
+	if job == nil || job.UserGCID != gcuid {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return job, true
+}
+
+// Serves the downloaded courses of a finished job to the client
+// ?format= picks the archive format (zip, tar.gz or tar.zst), or folder to sync the files to SYNC_FOLDER_PATH instead
+// Deletes the job's files once they are served, unless the job is partial and may still be resumed
+func HandleServeJob(w http.ResponseWriter, r *http.Request, store sessions.Store) {
+	log.Println("[HandleServeJob] hit")
+	job, ok := getUserJob(w, r, store)
+	if !ok {
+		return
+	}
+	if !job.IsServable() {
+		http.Error(w, "Job is "+string(job.Status), http.StatusConflict)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	archiver, isArchive := utils.Archivers[format]
+	syncFolderPath := utils.SyncFolderPath(job.UserGCID)
+	switch {
+	case format == "folder" && syncFolderPath == "":
+		http.Error(w, "Folder sync is disabled", http.StatusBadRequest)
+		return
+	case format != "folder" && !isArchive:
+		http.Error(w, "Unsupported format "+format, http.StatusBadRequest)
 		return
 	}
 
-	// Open the zip file
-	zipFile, err := os.Open(utils.ZipFilePath)
+	startServe := time.Now()
+	ctx := r.Context()
+	keyPrefix := utils.JobKeyPrefix(job.UserGCID, job.ID)
+
+	objects, err := utils.ContentStorage.List(ctx, keyPrefix)
 	if err != nil {
-		http.Error(w, "Failed to open zip file", http.StatusInternalServerError)
+		log.Printf("Error listing files of job %s: %v\n", job.ID, err)
+		http.Error(w, "Failed to list job files", http.StatusInternalServerError)
+		return
+	}
+	if len(objects) == 0 {
+		http.Error(w, "Job files were already served", http.StatusGone)
+		return
+	}
+	// Remove the job's files once served, a failed serve keeps them for another try
+	// Partial jobs keep them too: resuming only fetches the failed materials, the next serve needs the rest
+	removeJobFiles := func() {
+		if job.Status != models.JobStatusDone {
+			return
+		}
+		if err := storage.DeletePrefix(context.Background(), utils.ContentStorage, keyPrefix); err != nil {
+			log.Printf("Error removing files of job %s: %v\n", job.ID, err)
+		}
+	}
+
+	if format == "folder" {
+		copied, skipped, err := utils.SyncToFolder(ctx, utils.ContentStorage, keyPrefix, syncFolderPath)
+		if err != nil {
+			log.Printf("Error syncing job %s to %s: %v\n", job.ID, syncFolderPath, err)
+			http.Error(w, "Failed to sync folder", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Job files synced to %s in %v: %d copied, %d unchanged", syncFolderPath, time.Since(startServe), copied, skipped)
+		removeJobFiles()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"path":      syncFolderPath,
+			"copied":    copied,
+			"unchanged": skipped,
+		})
 		return
 	}
-	defer zipFile.Close()
 
-	log.Println("Serving zipped file...")
+	log.Printf("Serving %s archive...", format)
+	fileName := "GCD_" + utils.DownloadFolder + archiver.Extension()
+
+	// Storages reachable by clients get the archive, which is then downloaded from them directly
+	// Archives are kept under archives/ until utils.CleanArchives removes them once their link expired
+	archiveKey := storage.Key(utils.ArchivesKeyPrefix, job.UserGCID, job.ID+archiver.Extension())
+	url, err := utils.ContentStorage.Presign(ctx, archiveKey, utils.PresignExpiry, fileName)
+	if err == nil {
+		if err := storeArchive(ctx, archiver, keyPrefix, archiveKey); err != nil {
+			log.Printf("Error storing %s archive of job %s: %v\n", format, job.ID, err)
+			http.Error(w, "Failed to build archive", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%s archive stored in %v, redirecting to storage", format, time.Since(startServe))
+		removeJobFiles()
+		http.Redirect(w, r, url, http.StatusSeeOther)
+		return
+	}
+	if !errors.Is(err, storage.ErrPresignUnsupported) {
+		log.Printf("Error presigning archive of job %s: %v\n", job.ID, err)
+	}
 
 	// Set appropriate headers
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", "attachment; filename=GCD_"+utils.ZIP_FILE_NAME)
+	w.Header().Set("Content-Type", archiver.ContentType())
+	w.Header().Set("Content-Disposition", "attachment; filename="+fileName)
 
 	// Set appropriate headers for cross-origin access
 	w.Header().Set("Access-Control-Allow-Origin", os.Getenv("FRONTEND_URL"))
 	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept")
 
-	// Copy the zip file to the response writer
-	_, err = io.Copy(w, zipFile)
-	if err != nil {
-		http.Error(w, "Failed to copy zip file to response", http.StatusInternalServerError)
+	// Stream the archive as it is built, the status can't change once the first bytes are sent
+	if err := archiver.Archive(ctx, w, utils.ContentStorage, keyPrefix); err != nil {
+		log.Printf("Error streaming %s archive of job %s: %v\n", format, job.ID, err)
 		return
 	}
+	removeJobFiles()
 
 	// Close the response writer to ensure all data is flushed
 	if flusher, ok := w.(http.Flusher); ok {
@@ -214,5 +416,5 @@ func HandleServeCourses(w http.ResponseWriter, r *http.Request) {
 	}
 
 	elapsedServe := time.Since(startServe)
-	log.Printf("Zip file successfully served in %v", elapsedServe)
+	log.Printf("%s archive successfully served in %v", format, elapsedServe)
 }
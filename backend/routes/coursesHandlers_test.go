@@ -0,0 +1,455 @@
+package routes
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/models"
+	"github.com/mspcix/google-classroom-course-downloader/services"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+// Routes of the test server
+var testRoutes = map[string]string{
+	"ROUTE_OAUTH_URL":        "/oauth/url",
+	"ROUTE_OAUTH_CALLBACK":   "/oauth/callback",
+	"ROUTE_COURSES_DISCOVER": "/courses/discover",
+	"ROUTE_COURSES_LIST":     "/courses/list",
+	"ROUTE_COURSES_DOWNLOAD": "/courses/download",
+	"ROUTE_JOBS_STATUS":      "/jobs/{jobID}",
+	"ROUTE_JOBS_EVENTS":      "/jobs/{jobID}/events",
+	"ROUTE_JOBS_SERVE":       "/jobs/{jobID}/serve",
+	"ROUTE_JOBS_REPORT":      "/jobs/{jobID}/report",
+	"ROUTE_JOBS_RESUME":      "/jobs/{jobID}/resume",
+}
+
+// Starts the server's routes against the fake Google servers and returns a client logged in as the fixture user
+func startTestServer(t *testing.T) (*httptest.Server, *http.Client, *fakeGoogle) {
+	t.Helper()
+
+	endpoint, fake := setupOAuth(t)
+	for name, route := range testRoutes {
+		t.Setenv(name, route)
+	}
+	t.Setenv("FRONTEND_COURSES_URL", "http://frontend/courses")
+	t.Setenv("MAX_CONCURRENT_DOWNLOADS", "2")
+
+	store := newTestStore()
+	r := mux.NewRouter()
+	SetupRoutes(r, store)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	// Log in through the OAuth flow, the fake token endpoint stands for Google's
+	state, cookie := startLogin(t, store, endpoint)
+	if rec := callback(store, state, cookie); rec.Code != http.StatusSeeOther {
+		t.Fatalf("login: got status %d: %s", rec.Code, rec.Body)
+	} else {
+		cookie = sessionCookie(t, rec)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverURL, _ := url.Parse(server.URL)
+	jar.SetCookies(serverURL, []*http.Cookie{cookie})
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return server, client, fake
+}
+
+// Discovers the fixture courses and downloads them in a job, returning the job once finished
+func discoverAndDownload(t *testing.T, server *httptest.Server, client *http.Client) models.Job {
+	t.Helper()
+
+	// Discovery stores both courses of the fixtures
+	resp, err := client.Get(server.URL + "/courses/discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("discover: got status %d", resp.StatusCode)
+	}
+
+	var courses []models.Course
+	getJSON(t, client, server.URL+"/courses/list", &courses)
+	var coursesIDs []string
+	for _, course := range courses {
+		coursesIDs = append(coursesIDs, course.GCID)
+	}
+	sort.Strings(coursesIDs)
+	if strings.Join(coursesIDs, ",") != "course-1,course-2" {
+		t.Fatalf("discovered courses %v, want course-1 and course-2", coursesIDs)
+	}
+
+	// Download them as a job
+	body, _ := json.Marshal(map[string]interface{}{"selectedCoursesIDs": coursesIDs, "layout": models.LayoutTopic})
+	resp, err = client.Post(server.URL+"/courses/download", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queued struct {
+		JobID string `json:"jobId"`
+	}
+	json.NewDecoder(resp.Body).Decode(&queued)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || queued.JobID == "" {
+		t.Fatalf("download: got status %d and job %q", resp.StatusCode, queued.JobID)
+	}
+
+	return waitForJob(t, client, server.URL+"/jobs/"+queued.JobID)
+}
+
+// Same as discoverAndDownload, for jobs expected to be done
+func downloadJob(t *testing.T, server *httptest.Server, client *http.Client) string {
+	t.Helper()
+	job := discoverAndDownload(t, server, client)
+	if job.Status != models.JobStatusDone {
+		t.Fatalf("job %s: %s", job.Status, job.Error)
+	}
+	return job.ID
+}
+
+func TestDiscoverDownloadServe(t *testing.T) {
+	server, client, _ := startTestServer(t)
+	jobID := downloadJob(t, server, client)
+
+	// Serve the files as a zip
+	resp, err := client.Get(server.URL + "/jobs/" + jobID + "/serve?format=zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("serve: got status %d: %v", resp.StatusCode, err)
+	}
+	files := readZip(t, archive)
+
+	want := map[string]string{
+		"Algorithms/Announcements/01-02-2023/Syllabus.pdf":                "%PDF-1.4 syllabus",
+		"Algorithms/Announcements/01-02-2023/Announcement.txt":            "Welcome to the course!",
+		"Algorithms/Announcements/03-02-2023/Lecture 1.pdf":               "%PDF-1.4 lecture 1",
+		"Algorithms/Announcements/03-02-2023/links.txt":                   "https://www.youtube.com/watch?v=dQw4w9WgXcQ\n",
+		"Algorithms/Announcements/10-02-2023/links.txt":                   "https://example.com/calendar\n",
+		"Algorithms/01 - Readings/Reading list/Reading list.pdf":          "%PDF-1.4 reading list",
+		"Algorithms/01 - Readings/Reading list/Announcement.txt":          "Chapters to read before the exam",
+		"Algorithms/02 - Homework/Homework 1/Homework 1.pdf":              "%PDF-1.4 homework 1",
+		"Algorithms/02 - Homework/Homework 1/Details.txt":                 "Max points: 20",
+		"Algorithms/02 - Homework/Homework 1/My Submission/merge_sort.py": "def merge_sort(items):\n    return sorted(items)\n",
+		"Algorithms/02 - Homework/Homework 1/My Submission/Details.txt":   "Grade: 18",
+		"Databases/Announcements/10-01-2023/Announcement.txt":             "Exam results are out",
+	}
+	for name, content := range want {
+		got, ok := files[name]
+		switch {
+		case !ok:
+			t.Errorf("archive is missing %s", name)
+		case !strings.Contains(got, content):
+			t.Errorf("%s holds %q, want %q", name, got, content)
+		}
+	}
+	if t.Failed() {
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		t.Logf("archive files: %q", names)
+	}
+
+	// The files are gone once served
+	resp, err = client.Get(server.URL + "/jobs/" + jobID + "/serve?format=zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("second serve: got status %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+}
+
+func TestServeKeepsFilesOnFailure(t *testing.T) {
+	server, client, _ := startTestServer(t)
+	jobID := downloadJob(t, server, client)
+
+	// The sync folder can't be created under a file
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SYNC_FOLDER_PATH", blocker)
+
+	resp, err := client.Get(server.URL + "/jobs/" + jobID + "/serve?format=folder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("failed sync: got status %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+
+	// The files are still there to be served again
+	resp, err = client.Get(server.URL + "/jobs/" + jobID + "/serve?format=zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("serve after a failed sync: got status %d: %v", resp.StatusCode, err)
+	}
+	if files := readZip(t, archive); len(files) == 0 {
+		t.Errorf("archive served after a failed sync is empty")
+	}
+}
+
+func TestResumePartialJob(t *testing.T) {
+	server, client, fake := startTestServer(t)
+
+	fake.setFailing("file-homework", true)
+	job := discoverAndDownload(t, server, client)
+	if job.Status != models.JobStatusPartial {
+		t.Fatalf("job with a failed material is %s, want %s", job.Status, models.JobStatusPartial)
+	}
+
+	var report struct {
+		Done   int `json:"done"`
+		Failed int `json:"failed"`
+	}
+	getJSON(t, client, server.URL+"/jobs/"+job.ID+"/report", &report)
+	if report.Failed != 1 || report.Done == 0 {
+		t.Fatalf("report of the partial job: %+v", report)
+	}
+
+	workspacePath := utils.WorkspacePath(testUserGCID, job.ID)
+	if _, err := os.Stat(workspacePath); err != nil {
+		t.Errorf("workspace of the partial job not kept: %v", err)
+	}
+
+	// The partial archive can be served without losing the files a resume won't fetch again
+	if files := serveZip(t, server, client, job.ID); len(files) == 0 {
+		t.Fatal("archive of the partial job is empty")
+	} else if _, ok := files["Algorithms/02 - Homework/Homework 1/Homework 1.pdf"]; ok {
+		t.Fatal("archive of the partial job has the failed file")
+	}
+
+	// Resuming retries the failed material only
+	fake.setFailing("file-homework", false)
+	resp, err := client.Post(server.URL+"/jobs/"+job.ID+"/resume", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("resume: got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	if job := waitForJob(t, client, server.URL+"/jobs/"+job.ID); job.Status != models.JobStatusDone {
+		t.Fatalf("resumed job %s: %s", job.Status, job.Error)
+	}
+
+	if _, err := os.Stat(workspacePath); !os.IsNotExist(err) {
+		t.Errorf("workspace of the resumed job not removed: %v", err)
+	}
+
+	files := serveZip(t, server, client, job.ID)
+	for _, name := range []string{
+		"Algorithms/02 - Homework/Homework 1/Homework 1.pdf",
+		"Algorithms/Announcements/01-02-2023/Syllabus.pdf",
+	} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("archive of the resumed job is missing %s", name)
+		}
+	}
+}
+
+func getJSON(t *testing.T, client *http.Client, url string, v interface{}) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: got status %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+}
+
+// Polls the status of a job until it's finished
+func waitForJob(t *testing.T, client *http.Client, url string) models.Job {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		var job models.Job
+		getJSON(t, client, url, &job)
+		if job.IsFinished() {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job still %s after 30s", job.Status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Serves a job as a zip archive and returns its files
+func serveZip(t *testing.T, server *httptest.Server, client *http.Client, jobID string) map[string]string {
+	t.Helper()
+	resp, err := client.Get(server.URL + "/jobs/" + jobID + "/serve?format=zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("serve: got status %d: %v", resp.StatusCode, err)
+	}
+	return readZip(t, archive)
+}
+
+// Returns the content of the files of a zip archive by name
+func readZip(t *testing.T, archive []byte) map[string]string {
+	t.Helper()
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	files := make(map[string]string)
+	for _, file := range reader.File {
+		if strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		r, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = string(content)
+	}
+	return files
+}
+
+func TestResumeInterruptedJobsHonoursLeases(t *testing.T) {
+	server, client, fake := startTestServer(t)
+
+	fake.setFailing("file-homework", true)
+	job := discoverAndDownload(t, server, client)
+	fake.setFailing("file-homework", false)
+
+	// Pretend another process is running the job
+	if err := database.UpdateJobStatus(job.ID, models.JobStatusRunning, ""); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := database.ClaimJob(job.ID, "other-instance", time.Hour); err != nil || !claimed {
+		t.Fatalf("error leasing job to another process: %v", err)
+	}
+	if err := services.ResumeInterruptedJobs(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if leased, err := database.GetJobByID(job.ID); err != nil || leased.Status != models.JobStatusRunning || leased.Owner != "other-instance" {
+		t.Fatalf("job leased to another process was taken over: %+v, %v", leased, err)
+	}
+
+	// Once that process stops renewing the lease, the job is resumed
+	if _, err := database.ClaimJob(job.ID, "other-instance", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := services.ResumeInterruptedJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if job := waitForJob(t, client, server.URL+"/jobs/"+job.ID); job.Status != models.JobStatusDone {
+		t.Fatalf("job with an expired lease %s: %s", job.Status, job.Error)
+	}
+	if released, err := database.GetJobByID(job.ID); err != nil || released.Owner != "" {
+		t.Errorf("finished job still leased: %+v, %v", released, err)
+	}
+}
+
+// Exported files are recorded under their final name before they are downloaded
+func TestReportNamesExportedFiles(t *testing.T) {
+	server, client, fake := startTestServer(t)
+
+	fake.setFailing("file-reading", true)
+	job := discoverAndDownload(t, server, client)
+	if job.Status != models.JobStatusPartial {
+		t.Fatalf("job with a failed material is %s, want %s", job.Status, models.JobStatusPartial)
+	}
+
+	var report struct {
+		Failures []models.MaterialDownload `json:"failures"`
+	}
+	getJSON(t, client, server.URL+"/jobs/"+job.ID+"/report", &report)
+	if len(report.Failures) != 1 || report.Failures[0].FilePath != "Algorithms/01 - Readings/Reading list/Reading list.pdf" {
+		t.Fatalf("failures %+v, want the exported Reading list.pdf", report.Failures)
+	}
+}
+
+// The progress of a job run by another process isn't known here, the stream sends its status and ends
+func TestJobEventsOfJobRunElsewhere(t *testing.T) {
+	server, client, _ := startTestServer(t)
+
+	leaseExpiresAt := time.Now().Add(time.Hour)
+	job := models.Job{
+		ID:             "job-run-elsewhere",
+		UserGCID:       testUserGCID,
+		CoursesIDs:     []string{"course-1"},
+		Status:         models.JobStatusRunning,
+		CreatedAt:      time.Now(),
+		Owner:          "other-instance",
+		LeaseExpiresAt: &leaseExpiresAt,
+	}
+	if err := database.SaveJob(&job); err != nil {
+		t.Fatal(err)
+	}
+
+	client.Timeout = 5 * time.Second
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL + "/jobs/" + job.ID + "/events")
+		if err != nil {
+			t.Fatalf("stream of a job run elsewhere didn't end: %v", err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var event models.ProgressEvent
+		if err := json.Unmarshal(bytes.TrimSpace(bytes.TrimPrefix(data, []byte("data: "))), &event); err != nil {
+			t.Fatalf("got %q: %v", data, err)
+		}
+		if event.JobID != job.ID || event.Status != models.JobStatusRunning {
+			t.Errorf("got event %+v, want the running status of the job", event)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package routes
 
 import (
-	"fmt"
+	"crypto/subtle"
+	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/sessions"
 	_ "github.com/lib/pq"
@@ -15,19 +17,40 @@ import (
 	"github.com/mspcix/google-classroom-course-downloader/utils"
 )
 
-var storedState string
+// How long a user has to complete the login once the authentication URL is generated
+const oauthStateTTL = 10 * time.Minute
 
 // Generates the authentication URL and sends it to the frontend.
+// The state and PKCE code verifier are kept in the user's session until the callback.
 func HandleOAuthURL(w http.ResponseWriter, r *http.Request, store sessions.Store) {
 	log.Println("oauth/url route hit")
 
 	// Generate random state for oauth2 flow (protecting against CSRF)
-	storedState = utils.GenerateRandomID(32)
+	state := utils.GenerateRandomID(32)
 
-	url := utils.OAuthConfig.AuthCodeURL(storedState, oauth2.AccessTypeOffline)
+	verifier, err := utils.GenerateCodeVerifier()
+	if err != nil {
+		log.Println("Error generating code verifier:", err)
+		http.Error(w, "Failed to generate authentication URL", http.StatusInternalServerError)
+		return
+	}
+
+	session, _ := store.Get(r, "gcd_session")
+	session.Values["oauth_state"] = state
+	session.Values["oauth_verifier"] = verifier
+	session.Values["oauth_expiry"] = time.Now().Add(oauthStateTTL).Unix()
+	if err := session.Save(r, w); err != nil {
+		log.Println("Error saving session:", err)
+		http.Error(w, "Failed to generate authentication URL", http.StatusInternalServerError)
+		return
+	}
+
+	opts := append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, utils.CodeChallengeOptions(verifier)...)
+	url := utils.OAuthConfig.AuthCodeURL(state, opts...)
 
 	// Redirect the user to the generated URL)
-	fmt.Fprintf(w, `{"url": "%s"}`, url)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": url})
 }
 
 func HandleOAuthCallback(w http.ResponseWriter, r *http.Request, store sessions.Store) {
@@ -36,38 +59,64 @@ func HandleOAuthCallback(w http.ResponseWriter, r *http.Request, store sessions.
 	code := r.URL.Query().Get("code")
 	state := r.URL.Query().Get("state")
 
-	if storedState != state {
+	session, _ := store.Get(r, "gcd_session")
+	storedState, _ := session.Values["oauth_state"].(string)
+	verifier, _ := session.Values["oauth_verifier"].(string)
+	expiry, _ := session.Values["oauth_expiry"].(int64)
+
+	// The state and verifier can only be used once, whether the login succeeds or not
+	delete(session.Values, "oauth_state")
+	delete(session.Values, "oauth_verifier")
+	delete(session.Values, "oauth_expiry")
+
+	// Failed logins save the session too, so the deletion sticks
+	fail := func(message string, code int) {
+		if err := session.Save(r, w); err != nil {
+			log.Println("Error saving session:", err)
+		}
+		http.Error(w, message, code)
+	}
+
+	if storedState == "" || subtle.ConstantTimeCompare([]byte(storedState), []byte(state)) != 1 {
 		log.Println("Invalid state parameter")
-		http.Error(w, "Invalid state parameter", http.StatusBadRequest)
+		fail("Invalid state parameter", http.StatusBadRequest)
+		return
+	}
+	if time.Now().Unix() > expiry {
+		log.Println("Expired state parameter")
+		fail("Login expired, please try again", http.StatusBadRequest)
 		return
 	}
-	storedState = ""
 
-	token, err := utils.OAuthConfig.Exchange(r.Context(), code)
+	token, err := utils.OAuthConfig.Exchange(r.Context(), code, utils.CodeVerifierOption(verifier))
 	if err != nil {
 		log.Println("Error exchanging code for token:", err)
-		http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
+		fail("Failed to exchange token", http.StatusInternalServerError)
 		return
 	}
 
 	user, err := services.PopulateUserProfile(r.Context(), token)
 	if err != nil {
 		log.Println("Error getting user profile:", err)
-		http.Error(w, "Error getting user profile", http.StatusInternalServerError)
+		fail("Error getting user profile", http.StatusInternalServerError)
 		return
 	}
 
 	err = database.SaveUser(*user)
 	if err != nil {
 		log.Println("Error saving user to the database:", err)
-		http.Error(w, "Error saving user to the database", http.StatusInternalServerError)
+		fail("Error saving user to the database", http.StatusInternalServerError)
 		return
 	}
+	services.ResetUserTokenSource(user.GCUID)
 
-	session, _ := store.Get(r, "gcd_session")
 	session.Values["authenticated"] = true
 	session.Values["gcuid"] = user.GCUID
-	session.Save(r, w)
+	if err := session.Save(r, w); err != nil {
+		log.Println("Error saving session:", err)
+		http.Error(w, "Failed to save session", http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, os.Getenv("ROUTE_COURSES_DISCOVER"), http.StatusSeeOther)
 }
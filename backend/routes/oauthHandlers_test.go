@@ -0,0 +1,228 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+const (
+	testAuthCode = "test-auth-code"
+	// Google ID of the user of the fixtures
+	testUserGCID = "100000000000000000001"
+)
+
+// Fake OAuth token endpoint, handing out a token for testAuthCode
+// when the code verifier matches the challenge of the authentication URL
+type fakeTokenEndpoint struct {
+	mu        sync.Mutex
+	challenge string
+	exchanges int
+}
+
+func (e *fakeTokenEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code") != testAuthCode ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != e.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	e.exchanges++
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  "test-access-token",
+		"refresh_token": "test-refresh-token",
+		"token_type":    "Bearer",
+		"expires_in":    3600,
+	})
+}
+
+// Sets up the OAuth config against a fake token endpoint
+func setupOAuth(t *testing.T) (*fakeTokenEndpoint, *fakeGoogle) {
+	t.Helper()
+	fake := setupTest(t)
+	t.Setenv("ROUTE_COURSES_DISCOVER", "/courses/discover")
+
+	endpoint := &fakeTokenEndpoint{}
+	server := httptest.NewServer(endpoint)
+	t.Cleanup(server.Close)
+
+	oauthConfig := utils.OAuthConfig
+	utils.OAuthConfig = &oauth2.Config{
+		ClientID:     "test-client",
+		ClientSecret: "test-secret",
+		RedirectURL:  "http://localhost/oauth/callback",
+		Endpoint:     oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token"},
+	}
+	t.Cleanup(func() { utils.OAuthConfig = oauthConfig })
+
+	return endpoint, fake
+}
+
+// Requests the authentication URL and returns its state along with the session cookie
+func startLogin(t *testing.T, store sessions.Store, endpoint *fakeTokenEndpoint) (string, *http.Cookie) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	HandleOAuthURL(rec, httptest.NewRequest(http.MethodGet, "/oauth/url", nil), store)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("oauth url: got status %d: %s", rec.Code, rec.Body)
+	}
+
+	var body struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := url.Parse(body.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := authURL.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		t.Fatalf("authentication URL has no S256 code challenge: %s", body.URL)
+	}
+
+	endpoint.mu.Lock()
+	endpoint.challenge = query.Get("code_challenge")
+	endpoint.mu.Unlock()
+
+	return query.Get("state"), sessionCookie(t, rec)
+}
+
+// Sends the callback of the login with the session cookie
+func callback(store sessions.Store, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	query := url.Values{"code": {testAuthCode}, "state": {state}}
+	req := httptest.NewRequest(http.MethodGet, "/oauth/callback?"+query.Encode(), nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	HandleOAuthCallback(rec, req, store)
+	return rec
+}
+
+// Checks the session set by a response no longer holds a login in progress
+func assertStateCleared(t *testing.T, store sessions.Store, rec *httptest.ResponseRecorder) {
+	t.Helper()
+	session := readSession(t, store, sessionCookie(t, rec))
+	for _, key := range []string{"oauth_state", "oauth_verifier", "oauth_expiry"} {
+		if _, ok := session.Values[key]; ok {
+			t.Errorf("session still holds %s", key)
+		}
+	}
+}
+
+func TestOAuthCallbackValidState(t *testing.T) {
+	endpoint, _ := setupOAuth(t)
+	store := newTestStore()
+
+	state, cookie := startLogin(t, store, endpoint)
+	rec := callback(store, state, cookie)
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, http.StatusSeeOther, rec.Body)
+	}
+	if location := rec.Header().Get("Location"); location != "/courses/discover" {
+		t.Errorf("redirected to %q", location)
+	}
+
+	assertStateCleared(t, store, rec)
+	session := readSession(t, store, sessionCookie(t, rec))
+	gcuid, _ := session.Values["gcuid"].(string)
+	if session.Values["authenticated"] != true || gcuid != testUserGCID {
+		t.Errorf("session isn't authenticated as the fixture user: %v", session.Values)
+	}
+
+	user, err := database.GetUserByGCUID(gcuid)
+	if err != nil || user == nil {
+		t.Fatalf("user not saved: %v", err)
+	}
+	if user.Token != "test-access-token" || user.RefreshToken != "test-refresh-token" {
+		t.Errorf("user saved with tokens %q and %q", user.Token, user.RefreshToken)
+	}
+}
+
+func TestOAuthCallbackReplayedState(t *testing.T) {
+	endpoint, _ := setupOAuth(t)
+	store := newTestStore()
+
+	state, cookie := startLogin(t, store, endpoint)
+	first := callback(store, state, cookie)
+	if first.Code != http.StatusSeeOther {
+		t.Fatalf("first callback: got status %d: %s", first.Code, first.Body)
+	}
+
+	// The session returned by the first callback no longer has the state
+	replayed := callback(store, state, sessionCookie(t, first))
+	if replayed.Code != http.StatusBadRequest {
+		t.Errorf("replayed callback: got status %d, want %d", replayed.Code, http.StatusBadRequest)
+	}
+	if endpoint.exchanges != 1 {
+		t.Errorf("code exchanged %d times, want 1", endpoint.exchanges)
+	}
+}
+
+func TestOAuthCallbackMismatchedState(t *testing.T) {
+	endpoint, _ := setupOAuth(t)
+	store := newTestStore()
+
+	state, cookie := startLogin(t, store, endpoint)
+	rec := callback(store, state+"x", cookie)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	assertStateCleared(t, store, rec)
+
+	// The right state can't be used with the session the failed callback left
+	if rec := callback(store, state, sessionCookie(t, rec)); rec.Code != http.StatusBadRequest {
+		t.Errorf("callback after a mismatch: got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if endpoint.exchanges != 0 {
+		t.Errorf("code exchanged %d times, want 0", endpoint.exchanges)
+	}
+}
+
+func TestOAuthCallbackExpiredState(t *testing.T) {
+	endpoint, _ := setupOAuth(t)
+	store := newTestStore()
+
+	state, cookie := startLogin(t, store, endpoint)
+
+	// Move the expiry of the login to the past
+	session := readSession(t, store, cookie)
+	session.Values["oauth_expiry"] = time.Now().Add(-time.Minute).Unix()
+	rec := httptest.NewRecorder()
+	if err := session.Save(httptest.NewRequest(http.MethodGet, "/", nil), rec); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = callback(store, state, sessionCookie(t, rec))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	assertStateCleared(t, store, rec)
+	if endpoint.exchanges != 0 {
+		t.Errorf("code exchanged %d times, want 0", endpoint.exchanges)
+	}
+}
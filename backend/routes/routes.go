@@ -19,7 +19,11 @@ func SetupRoutes(r *mux.Router, store sessions.Store) {
 	r.HandleFunc(os.Getenv("ROUTE_COURSES_DISCOVER"), authMiddleware(withStore(HandleDiscoverCourses, store), store))
 	r.HandleFunc(os.Getenv("ROUTE_COURSES_LIST"), authMiddleware(withStore(HandleListCourses, store), store))
 	r.HandleFunc(os.Getenv("ROUTE_COURSES_DOWNLOAD"), authMiddleware(withStore(HandleDownloadCourses, store), store))
-	r.HandleFunc(os.Getenv("ROUTE_COURSES_SERVE"), authMiddleware(HandleServeCourses, store))
+	r.HandleFunc(os.Getenv("ROUTE_JOBS_STATUS"), authMiddleware(withStore(HandleJobStatus, store), store))
+	r.HandleFunc(os.Getenv("ROUTE_JOBS_EVENTS"), authMiddleware(withStore(HandleJobEvents, store), store))
+	r.HandleFunc(os.Getenv("ROUTE_JOBS_SERVE"), authMiddleware(withStore(HandleServeJob, store), store))
+	r.HandleFunc(os.Getenv("ROUTE_JOBS_REPORT"), authMiddleware(withStore(HandleJobReport, store), store))
+	r.HandleFunc(os.Getenv("ROUTE_JOBS_RESUME"), authMiddleware(withStore(HandleResumeJob, store), store)).Methods("POST")
 }
 
 // Checks if the user is authenticated
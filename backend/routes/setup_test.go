@@ -0,0 +1,117 @@
+package routes
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"github.com/gorilla/sessions"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/fakegoogle"
+	"github.com/mspcix/google-classroom-course-downloader/storage"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+// Sets up what the handlers need for a test: a fresh SQLite database, a token encryption key,
+// local storage in a temporary folder and a fake Classroom and Drive server serving the default fixtures
+// The globals changed here are restored when the test ends
+func setupTest(t *testing.T) *fakeGoogle {
+	t.Helper()
+
+	t.Setenv("TOKEN_ENCRYPTION_KEYS", "test:"+base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err := utils.InitTokenKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.Open(sqlite.Open(filepath.Join(t.TempDir(), "gcd.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	fake := &fakeGoogle{handler: fakegoogle.NewHandler(fakegoogle.DefaultFixtures()), failing: make(map[string]bool)}
+	fake.Server = httptest.NewServer(fake)
+	t.Cleanup(fake.Close)
+
+	classroomAPIURL, driveAPIURL := utils.ClassroomAPIURL, utils.DriveAPIURL
+	utils.ClassroomAPIURL, utils.DriveAPIURL = fake.URL, fake.URL
+	t.Cleanup(func() { utils.ClassroomAPIURL, utils.DriveAPIURL = classroomAPIURL, driveAPIURL })
+
+	if err := utils.InitExportFormats(); err != nil {
+		t.Fatal(err)
+	}
+	utils.InitStoredExtensions()
+
+	downloadFolderPath, contentStorage := utils.DownloadFolderPath, utils.ContentStorage
+	utils.DownloadFolderPath = t.TempDir()
+	utils.ContentStorage = storage.NewLocal(utils.DownloadFolderPath)
+	t.Cleanup(func() { utils.DownloadFolderPath, utils.ContentStorage = downloadFolderPath, contentStorage })
+
+	return fake
+}
+
+// Fake Classroom and Drive server that can be told to fail the downloads of some Drive files
+type fakeGoogle struct {
+	*httptest.Server
+	handler http.Handler
+
+	mu      sync.Mutex
+	failing map[string]bool
+}
+
+func (f *fakeGoogle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	fail := f.failing[path.Base(strings.TrimSuffix(r.URL.Path, "/export"))]
+	f.mu.Unlock()
+	if fail && strings.HasPrefix(r.URL.Path, "/drive/") {
+		http.Error(w, "Drive file unavailable", http.StatusNotFound)
+		return
+	}
+	f.handler.ServeHTTP(w, r)
+}
+
+// Makes the downloads of a Drive file fail, or succeed again
+func (f *fakeGoogle) setFailing(fileID string, failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[fileID] = failing
+}
+
+func newTestStore() sessions.Store {
+	return sessions.NewCookieStore([]byte("test-session-key-test-session-key"))
+}
+
+// Returns the session cookie set by a response, failing the test if there's none
+func sessionCookie(t *testing.T, rec *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "gcd_session" {
+			return cookie
+		}
+	}
+	t.Fatalf("response sets no session cookie")
+	return nil
+}
+
+// Reads the session a cookie holds
+func readSession(t *testing.T, store sessions.Store, cookie *http.Cookie) *sessions.Session {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookie)
+	session, err := store.Get(req, "gcd_session")
+	if err != nil {
+		t.Fatalf("error reading session: %v", err)
+	}
+	return session
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/mspcix/google-classroom-course-downloader/models"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+// Page size requested from the list endpoints of the Classroom API
+const classroomPageSize = 50
+
+// Reads a user's data from Google Classroom
+// Every list method follows the pages until the last one
+type ClassroomClient interface {
+	GetUserProfile(ctx context.Context) (*models.GCProfile, error)
+	ListCourses(ctx context.Context, filter CourseFilter) ([]models.Course, error)
+	ListAnnouncements(ctx context.Context, courseID string) ([]models.Announcement, error)
+	ListCourseWorkMaterials(ctx context.Context, courseID string) ([]models.CourseWorkMaterial, error)
+	ListCourseWork(ctx context.Context, courseID string) ([]models.CourseWork, error)
+	ListStudentSubmissions(ctx context.Context, courseID string) ([]models.StudentSubmission, error)
+	ListTopics(ctx context.Context, courseID string) ([]models.Topic, error)
+}
+
+// ClassroomClient calling the Classroom REST API at baseURL
+type httpClassroomClient struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// Returns a client calling the Classroom API at utils.ClassroomAPIURL with the user's token
+func NewClassroomClient(ts oauth2.TokenSource) ClassroomClient {
+	return NewClassroomClientWithURL(utils.ClassroomAPIURL, utils.NewAPIClient(ts))
+}
+
+// Returns a client calling the Classroom API at baseURL, e.g. a fake server
+func NewClassroomClientWithURL(baseURL string, httpClient *http.Client) ClassroomClient {
+	return &httpClassroomClient{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: httpClient}
+}
+
+func (c *httpClassroomClient) GetUserProfile(ctx context.Context) (*models.GCProfile, error) {
+	var profile models.GCProfile
+	if err := c.get(ctx, "/v1/userProfiles/me", nil, &profile); err != nil {
+		return nil, fmt.Errorf("error getting user profile: %w", err)
+	}
+	return &profile, nil
+}
+
+func (c *httpClassroomClient) ListCourses(ctx context.Context, filter CourseFilter) ([]models.Course, error) {
+	courses, err := listPages[models.Course](ctx, c, "/v1/courses", filter.Query(), "courses")
+	if err != nil {
+		return nil, fmt.Errorf("error getting classrooms: %w", err)
+	}
+	return courses, nil
+}
+
+func (c *httpClassroomClient) ListAnnouncements(ctx context.Context, courseID string) ([]models.Announcement, error) {
+	return listPages[models.Announcement](ctx, c, coursePath(courseID, "announcements"), nil, "announcements")
+}
+
+func (c *httpClassroomClient) ListCourseWorkMaterials(ctx context.Context, courseID string) ([]models.CourseWorkMaterial, error) {
+	return listPages[models.CourseWorkMaterial](ctx, c, coursePath(courseID, "courseWorkMaterials"), nil, "courseWorkMaterial")
+}
+
+func (c *httpClassroomClient) ListCourseWork(ctx context.Context, courseID string) ([]models.CourseWork, error) {
+	return listPages[models.CourseWork](ctx, c, coursePath(courseID, "courseWork"), nil, "courseWork")
+}
+
+// "-" lists the submissions of every course work of the course, userId=me keeps only the user's own
+func (c *httpClassroomClient) ListStudentSubmissions(ctx context.Context, courseID string) ([]models.StudentSubmission, error) {
+	query := url.Values{"userId": {"me"}}
+	return listPages[models.StudentSubmission](ctx, c, coursePath(courseID, "courseWork/-/studentSubmissions"), query, "studentSubmissions")
+}
+
+func (c *httpClassroomClient) ListTopics(ctx context.Context, courseID string) ([]models.Topic, error) {
+	return listPages[models.Topic](ctx, c, coursePath(courseID, "topics"), nil, "topic")
+}
+
+func coursePath(courseID, resource string) string {
+	return "/v1/courses/" + url.PathEscape(courseID) + "/" + resource
+}
+
+// Fetches every page of a list endpoint, the items of each page being under key
+func listPages[T any](ctx context.Context, c *httpClassroomClient, path string, query url.Values, key string) ([]T, error) {
+	params := url.Values{}
+	for k, v := range query {
+		params[k] = v
+	}
+	params.Set("pageSize", fmt.Sprint(classroomPageSize))
+
+	items := []T{}
+	for {
+		var page map[string]json.RawMessage
+		if err := c.get(ctx, path, params, &page); err != nil {
+			return nil, err
+		}
+
+		if raw, ok := page[key]; ok {
+			var pageItems []T
+			if err := json.Unmarshal(raw, &pageItems); err != nil {
+				return nil, fmt.Errorf("error decoding %s: %w", key, err)
+			}
+			items = append(items, pageItems...)
+		}
+
+		var nextPageToken string
+		if raw, ok := page["nextPageToken"]; ok {
+			if err := json.Unmarshal(raw, &nextPageToken); err != nil {
+				return nil, fmt.Errorf("error decoding nextPageToken: %w", err)
+			}
+		}
+		if nextPageToken == "" {
+			return items, nil
+		}
+		params.Set("pageToken", nextPageToken)
+	}
+}
+
+// Sends a GET request to the API and decodes the JSON response into v
+func (c *httpClassroomClient) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	requestURL := c.baseURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if err := utils.CheckResponse(response); err != nil {
+		return err
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding response of %s: %w", path, err)
+	}
+	return nil
+}
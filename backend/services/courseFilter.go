@@ -0,0 +1,66 @@
+package services
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Course states accepted by the courseStates filter of the Classroom API
+var validCourseStates = map[string]bool{
+	"ACTIVE":      true,
+	"ARCHIVED":    true,
+	"PROVISIONED": true,
+	"DECLINED":    true,
+	"SUSPENDED":   true,
+}
+
+// Restricts the courses listed by Classroom
+// Empty fields don't filter: every state, and the courses the user studies or teaches
+type CourseFilter struct {
+	States    []string
+	StudentID string // "me", a user ID or an email address
+	TeacherID string
+}
+
+// Reads the filter from the courseStates, studentId and teacherId parameters
+// courseStates is a comma separated list, DISCOVER_COURSE_STATES is used when it's missing
+func ParseCourseFilter(query url.Values) (CourseFilter, error) {
+	filter := CourseFilter{
+		StudentID: strings.TrimSpace(query.Get("studentId")),
+		TeacherID: strings.TrimSpace(query.Get("teacherId")),
+	}
+
+	states := query.Get("courseStates")
+	if !query.Has("courseStates") {
+		states = os.Getenv("DISCOVER_COURSE_STATES")
+	}
+	for _, state := range strings.Split(states, ",") {
+		state = strings.ToUpper(strings.TrimSpace(state))
+		if state == "" {
+			continue
+		}
+		if !validCourseStates[state] {
+			return filter, fmt.Errorf("invalid course state %q", state)
+		}
+		filter.States = append(filter.States, state)
+	}
+
+	return filter, nil
+}
+
+// Query parameters of the filter for the courses.list endpoint
+func (f CourseFilter) Query() url.Values {
+	query := url.Values{}
+	for _, state := range f.States {
+		query.Add("courseStates", state)
+	}
+	if f.StudentID != "" {
+		query.Set("studentId", f.StudentID)
+	}
+	if f.TeacherID != "" {
+		query.Set("teacherId", f.TeacherID)
+	}
+	return query
+}
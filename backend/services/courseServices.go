@@ -1,10 +1,10 @@
 package services
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,16 +15,18 @@ import (
 
 	"github.com/mspcix/google-classroom-course-downloader/database"
 	"github.com/mspcix/google-classroom-course-downloader/models"
+	"github.com/mspcix/google-classroom-course-downloader/storage"
 	"github.com/mspcix/google-classroom-course-downloader/utils"
 )
 
-// Return courses that aren't present in the db.
-func FilterNewCourses(classrooms []models.Course) ([]models.Course, error) {
+// Split courses between the ones that aren't present in the db and the ones that are.
+func SplitNewCourses(classrooms []models.Course) ([]models.Course, []models.Course, error) {
 	newClassrooms := []models.Course{}
+	existingClassrooms := []models.Course{}
 
 	existingClassroomsIDs, err := database.GetCoursesGCIDs()
 	if err != nil {
-		return newClassrooms, err
+		return newClassrooms, existingClassrooms, err
 	}
 
 	// Convert the existingClassroomsID slice into a map for faster lookups.
@@ -36,148 +38,255 @@ func FilterNewCourses(classrooms []models.Course) ([]models.Course, error) {
 	for _, classroom := range classrooms {
 		if !existingIDsMap[classroom.GCID] {
 			newClassrooms = append(newClassrooms, classroom)
+		} else {
+			existingClassrooms = append(existingClassrooms, classroom)
 		}
 	}
 
-	return newClassrooms, nil
+	return newClassrooms, existingClassrooms, nil
 }
 
-// Fetch the classrooms for the user using Google Classroom API
-func GetCoursesFromAPI(r *http.Request, token string) ([]models.Course, error) {
-	httpClient := utils.OAuthConfig.Client(r.Context(), &oauth2.Token{AccessToken: token})
+// Fetch the announcements, course work materials, course work, submissions and topics
+// of courses using Google Classroom API and sets them on the courses
+// Courses and resource types are fetched in parallel, up to MAX_CONCURRENT_DISCOVERY requests at a time
+func PopulateCoursesContent(ctx context.Context, client ClassroomClient, courses []models.Course) error {
+	if len(courses) == 0 {
+		return nil
+	}
 
-	// Makes a GET request to the Classroom API to retrieve the list of classrooms
-	response, err := httpClient.Get("https://classroom.googleapis.com/v1/courses")
-	if err != nil {
-		return nil, fmt.Errorf("error getting classrooms: %w", err)
+	maxConcurrentDiscovery, err := strconv.Atoi(os.Getenv("MAX_CONCURRENT_DISCOVERY"))
+	if err != nil || maxConcurrentDiscovery < 1 {
+		maxConcurrentDiscovery = 1
 	}
-	defer response.Body.Close()
 
-	// Parse the response body to get the list of classrooms
-	var classroomsResponse struct {
-		Courses []models.Course `json:"courses"`
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Every fetch writes to its own slot, so the results don't depend on the order the fetches end in
+	contents := make([]courseContent, len(courses))
+	for i := range contents {
+		contents[i].apiTime = make([]time.Duration, len(courseContentFetchers))
 	}
-	err = json.NewDecoder(response.Body).Decode(&classroomsResponse)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding classrooms response: %w", err)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	semaphore := make(chan struct{}, maxConcurrentDiscovery)
+
+	for i := range courses {
+		for j, fetcher := range courseContentFetchers {
+			i, j, fetcher := i, j, fetcher // Capture range variables
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				semaphore <- struct{}{}
+				defer func() { <-semaphore }()
+
+				// Stop early once a fetch failed
+				if ctx.Err() != nil {
+					return
+				}
+
+				start := time.Now()
+				err := fetcher.fetch(ctx, client, courses[i].GCID, &contents[i])
+				contents[i].apiTime[j] = time.Since(start)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("error retrieving %s of course %s: %w", fetcher.resource, courses[i].GCID, err)
+						cancel()
+					})
+				}
+			}()
+		}
 	}
+	wg.Wait()
 
-	// Populate the UserID field (foreign key) of each course
-	gcuid, err := database.GetGCUIDByToken(token)
-	if err != nil {
-		return nil, err
+	if firstErr != nil {
+		return firstErr
 	}
 
-	for i := range classroomsResponse.Courses {
-		classroomsResponse.Courses[i].UserGCID = gcuid
+	for i := range courses {
+		content := contents[i]
+
+		// Attach the submissions to their course work
+		submissionsMap := make(map[string][]models.StudentSubmission)
+		for _, submission := range content.submissions {
+			submissionsMap[submission.CourseWorkGCID] = append(submissionsMap[submission.CourseWorkGCID], submission)
+		}
+		for j := range content.courseWork {
+			content.courseWork[j].Submissions = submissionsMap[content.courseWork[j].GCID]
+		}
+
+		courses[i].Announcements = content.announcements
+		courses[i].CourseWorkMaterials = content.courseWorkMaterials
+		courses[i].CourseWork = content.courseWork
+		courses[i].Topics = content.topics
+
+		var total time.Duration
+		for _, d := range content.apiTime {
+			total += d
+		}
+		log.Printf("Course %s discovered: %d announcements, %d materials, %d course work, %d submissions, %d topics in %v of API time",
+			courses[i].GCID, len(content.announcements), len(content.courseWorkMaterials), len(content.courseWork),
+			len(content.submissions), len(content.topics), total.Round(time.Millisecond))
 	}
 
-	return classroomsResponse.Courses, nil
+	return nil
 }
 
-// Fetch all announcements of a list of courses using Google Classroom API
-func GetAnnouncements(r *http.Request, token string, coursesIDs []string) ([]models.Announcement, error) {
-	httpClient := utils.OAuthConfig.Client(r.Context(), &oauth2.Token{AccessToken: token})
-
-	announcements := []models.Announcement{}
-	for _, courseID := range coursesIDs {
-		nextPageToken := ""
-		for {
-			// Make a GET request to the Classroom API to retrieve the list of announcements
-			url := fmt.Sprintf("https://classroom.googleapis.com/v1/courses/%s/announcements", courseID)
-			if nextPageToken != "" {
-				url += "?pageToken=" + nextPageToken
-			}
+// Content of a course fetched during discovery, along with the time spent fetching each resource type
+// Each fetcher only writes its own fields, so they can run at the same time
+type courseContent struct {
+	announcements       []models.Announcement
+	courseWorkMaterials []models.CourseWorkMaterial
+	courseWork          []models.CourseWork
+	submissions         []models.StudentSubmission
+	topics              []models.Topic
+	apiTime             []time.Duration
+}
 
-			response, err := httpClient.Get(url)
-			if err != nil {
-				log.Printf("error getting announcements: %v", err)
-				return nil, err
-			}
-			defer response.Body.Close()
+// Fetches one resource type of a course into its content
+type courseContentFetcher struct {
+	resource string
+	fetch    func(ctx context.Context, client ClassroomClient, courseID string, content *courseContent) error
+}
 
-			// Parse the response body to get the list of announcements
-			var announcementsResponse struct {
-				Announcements []models.Announcement `json:"announcements"`
-				NextPageToken string                `json:"nextPageToken"`
-			}
-			err = json.NewDecoder(response.Body).Decode(&announcementsResponse)
-			if err != nil {
-				log.Printf("error decoding announcements response: %v", err)
-				return nil, err
-			}
+var courseContentFetchers = []courseContentFetcher{
+	{"announcements", func(ctx context.Context, client ClassroomClient, courseID string, content *courseContent) (err error) {
+		content.announcements, err = GetAnnouncements(ctx, client, courseID)
+		return err
+	}},
+	{"course work materials", func(ctx context.Context, client ClassroomClient, courseID string, content *courseContent) (err error) {
+		content.courseWorkMaterials, err = GetCourseWorkMaterials(ctx, client, courseID)
+		return err
+	}},
+	{"course work", func(ctx context.Context, client ClassroomClient, courseID string, content *courseContent) (err error) {
+		content.courseWork, err = GetCourseWork(ctx, client, courseID)
+		return err
+	}},
+	{"student submissions", func(ctx context.Context, client ClassroomClient, courseID string, content *courseContent) (err error) {
+		content.submissions, err = GetStudentSubmissions(ctx, client, courseID)
+		return err
+	}},
+	{"topics", func(ctx context.Context, client ClassroomClient, courseID string, content *courseContent) (err error) {
+		content.topics, err = GetTopics(ctx, client, courseID)
+		return err
+	}},
+}
 
-			// Set the title, type and url of materials
-			for i := range announcementsResponse.Announcements {
-				for j := range announcementsResponse.Announcements[i].Materials {
-					announcementsResponse.Announcements[i].Materials[j].SetTitleTypeURL()
-				}
-			}
+// Brings courses already in the db up to date with Classroom
+// The courses must have been populated with their content first, using the user's token
+func SyncCourses(courses []models.Course, gcuid string) (database.SyncStats, error) {
+	var stats database.SyncStats
+	for _, course := range courses {
+		courseStats, err := database.SyncCourse(course, gcuid)
+		if err != nil {
+			return stats, err
+		}
+		log.Printf("Course %s synced: %d inserted, %d updated, %d removed",
+			course.GCID, courseStats.Inserted, courseStats.Updated, courseStats.Removed)
+		stats.Add(courseStats)
+	}
+	return stats, nil
+}
 
-			announcements = append(announcements, announcementsResponse.Announcements...)
+// Fetch the classrooms of the user matching the filter using Google Classroom API
+func GetCoursesFromAPI(ctx context.Context, client ClassroomClient, filter CourseFilter) ([]models.Course, error) {
+	return client.ListCourses(ctx, filter)
+}
 
-			// Check if there's a nextPageToken and continue fetching next page
-			nextPageToken = announcementsResponse.NextPageToken
-			if nextPageToken == "" {
-				break
-			}
+// Fetch all announcements of a course using Google Classroom API
+func GetAnnouncements(ctx context.Context, client ClassroomClient, courseID string) ([]models.Announcement, error) {
+	announcements, err := client.ListAnnouncements(ctx, courseID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the title, type and url of materials
+	for i := range announcements {
+		for j := range announcements[i].Materials {
+			announcements[i].Materials[j].SetTitleTypeURL()
 		}
 	}
 
 	return announcements, nil
 }
 
-// Fetch the coursework materials of a list of courses using Google Classroom API
-func GetCourseWorkMaterials(r *http.Request, token string, courseIDs []string) ([]models.CourseWorkMaterial, error) {
-	httpClient := utils.OAuthConfig.Client(r.Context(), &oauth2.Token{AccessToken: token})
+// Fetch the coursework materials of a course using Google Classroom API
+func GetCourseWorkMaterials(ctx context.Context, client ClassroomClient, courseID string) ([]models.CourseWorkMaterial, error) {
+	courseWorkMaterials, err := client.ListCourseWorkMaterials(ctx, courseID)
+	if err != nil {
+		return nil, err
+	}
 
-	var allCourseWorkMaterials []models.CourseWorkMaterial
+	// Set the title, type and url of materials
+	for i := range courseWorkMaterials {
+		for j := range courseWorkMaterials[i].Materials {
+			courseWorkMaterials[i].Materials[j].SetTitleTypeURL()
+		}
+	}
 
-	for _, courseID := range courseIDs {
-		nextPageToken := ""
-		for {
-			// Make a GET request to the Classroom API to retrieve the list of coursework materials
-			url := fmt.Sprintf("https://classroom.googleapis.com/v1/courses/%s/courseWorkMaterials?pageSize=50&pageToken=%s", courseID, nextPageToken)
-			response, err := httpClient.Get(url)
-			if err != nil {
-				return nil, err
-			}
-			defer response.Body.Close()
+	return courseWorkMaterials, nil
+}
 
-			// Parse the response body to get the list of coursework materials
-			var courseWorkMaterialsResponse struct {
-				CourseWorkMaterials []models.CourseWorkMaterial `json:"courseWorkMaterial"`
-				NextPageToken       string                      `json:"nextPageToken"`
-			}
-			err = json.NewDecoder(response.Body).Decode(&courseWorkMaterialsResponse)
-			if err != nil {
-				return nil, err
-			}
+// Fetch the course work (assignments and questions) of a course using Google Classroom API
+func GetCourseWork(ctx context.Context, client ClassroomClient, courseID string) ([]models.CourseWork, error) {
+	courseWork, err := client.ListCourseWork(ctx, courseID)
+	if err != nil {
+		return nil, err
+	}
 
-			// Set the title, type and url of materials
-			for i := range courseWorkMaterialsResponse.CourseWorkMaterials {
-				for j := range courseWorkMaterialsResponse.CourseWorkMaterials[i].Materials {
-					courseWorkMaterialsResponse.CourseWorkMaterials[i].Materials[j].SetTitleTypeURL()
-				}
-			}
+	// Set the title, type and url of materials
+	for i := range courseWork {
+		for j := range courseWork[i].Materials {
+			courseWork[i].Materials[j].SetTitleTypeURL()
+		}
+	}
 
-			allCourseWorkMaterials = append(allCourseWorkMaterials, courseWorkMaterialsResponse.CourseWorkMaterials...)
+	return courseWork, nil
+}
 
-			// Check if there are more pages to fetch
-			if courseWorkMaterialsResponse.NextPageToken == "" {
-				break
-			}
-			nextPageToken = courseWorkMaterialsResponse.NextPageToken
+// Fetch the user's own submissions to the course work of a course using Google Classroom API
+func GetStudentSubmissions(ctx context.Context, client ClassroomClient, courseID string) ([]models.StudentSubmission, error) {
+	submissions, err := client.ListStudentSubmissions(ctx, courseID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store the attachments as materials
+	for i := range submissions {
+		submission := &submissions[i]
+		for _, attachment := range submission.AssignmentSubmission.Attachments {
+			submission.Materials = append(submission.Materials, attachment.ToMaterial())
 		}
 	}
 
-	return allCourseWorkMaterials, nil
+	return submissions, nil
 }
 
-// Download courses' materials from links in the database
-func DownloadCourses(coursesIDs []string, token *string) error {
-	log.Printf("Downloading %v course(s)...", len(coursesIDs))
-	courses, err := database.GetCoursesByIDs(coursesIDs)
+// Fetch the topics of a course using Google Classroom API
+// Topics keep the order they are listed in, which is their order in Classroom
+func GetTopics(ctx context.Context, client ClassroomClient, courseID string) ([]models.Topic, error) {
+	topics, err := client.ListTopics(ctx, courseID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range topics {
+		topics[i].Position = i
+	}
+
+	return topics, nil
+}
+
+// Download courses' materials from links in the database into the job's workspace
+// Reports the progress to the subscribers of the job
+// Files are fetched with the user's token source, which refreshes the token as the download goes
+// The state of each material is recorded, so running the job again skips the materials already
+// saved and continues the partial files
+// Stops starting materials once ctx is done, and returns its error
+func DownloadCourses(ctx context.Context, job models.Job) error {
+	log.Printf("Downloading %v course(s)...", len(job.CoursesIDs))
+	courses, err := database.GetCoursesByIDs(job.CoursesIDs, job.UserGCID)
 	if err != nil {
 		return err
 	}
@@ -190,45 +299,45 @@ func DownloadCourses(coursesIDs []string, token *string) error {
 		return err
 	}
 	semaphore := make(chan struct{}, maxConcurrentDownloads)
+	workspacePath := utils.WorkspacePath(job.UserGCID, job.ID)
+	keyPrefix := utils.JobKeyPrefix(job.UserGCID, job.ID)
 
-	for _, course := range courses {
-		courseDownloadItems := course.GetDownloadItems()
-		downloadItems = append(downloadItems, courseDownloadItems...)
+	// Folder paths are relative, they are both keys under the job's prefix and local folders of the workspace
+	downloadItems = models.JobDownloadItems(courses, job.Layout)
+
+	state, err := loadDownloadState(job.ID)
+	if err != nil {
+		return err
 	}
 
-	// Create a channel to signal when the download is complete
-	downloadCompleteCh := make(chan struct{})
+	progress := getJobProgress(job.ID)
+	progress.setItems(downloadItems)
 
-	// Start the token refreshing goroutine
-	go func() {
-		defer close(downloadCompleteCh)
-		ticker := time.NewTicker(20 * time.Minute) // Refresh token every 20 minutes
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				RefreshToken(token)
-			case <-downloadCompleteCh:
-				return
-			}
-		}
-	}()
+	ts := UserTokenSource(job.UserGCID)
 
 	for _, item := range downloadItems {
-		item := item // Capture range variable
 		wg.Add(1)
 		go func(item models.DownloadItem) {
 			defer wg.Done()
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
+			if ctx.Err() != nil {
+				return
+			}
+			defer progress.itemFinished(item)
 
-			if err := os.MkdirAll(item.DownloadFolderPath, os.ModePerm); err != nil {
-				log.Printf("error creating folder: %v", err)
+			progress.itemStarted(item)
+			target := itemTarget{
+				scratchDir: filepath.Join(workspacePath, item.DownloadFolderPath),
+				key:        storage.Key(keyPrefix, filepath.ToSlash(item.DownloadFolderPath)),
+			}
+			// Files get the time of the last update of their item in Classroom
+			if updateTime, err := time.Parse(time.RFC3339, item.UpdateTime); err == nil {
+				target.modTime = updateTime
 			}
 
 			// Save materials and download files
-			if err := saveDownloadItem(item, token); err != nil {
+			if err := saveDownloadItem(ctx, item, target, ts, state, progress); err != nil {
 				log.Printf("error saving materials: %v", err)
 			}
 		}(item)
@@ -236,79 +345,236 @@ func DownloadCourses(coursesIDs []string, token *string) error {
 
 	// Wait for downloads to complete
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	// Signal that the download is complete, stopping the token refreshing goroutine
-	downloadCompleteCh <- struct{}{}
+	// Every file is in storage once all materials are saved, otherwise the workspace
+	// keeps the partial files of the failed ones for the job to be resumed
+	if state.allDone() {
+		if err := utils.RemoveWorkspace(workspacePath); err != nil {
+			log.Printf("error removing workspace: %v", err)
+		}
+	}
 
 	log.Println("Finished downloading courses")
 	return nil
 }
 
-func saveDownloadItem(item models.DownloadItem, token *string) error {
+// Where the files of a download item go
+type itemTarget struct {
+	scratchDir string    // Local folder holding the item's Drive files while they download
+	key        string    // Storage key of the item's folder
+	modTime    time.Time // Modification time given to the item's files
+}
+
+func saveDownloadItem(ctx context.Context, item models.DownloadItem, target itemTarget, ts oauth2.TokenSource, state *downloadState, progress *jobProgress) error {
+	// Announcement.txt may be shared by several items, so the text is appended
 	if item.Text != "" {
-		err := saveItemText(item.DownloadFolderPath, item.Text)
-		if err != nil {
-			log.Printf("error saving text: %v", err)
+		if err := saveItemFile(ctx, item, target, state, models.ItemFileText, "Announcement.txt", item.Text, appendToFile); err != nil {
+			return err
+		}
+	}
+
+	if item.Details != "" {
+		if err := saveItemFile(ctx, item, target, state, models.ItemFileDetails, "Details.txt", item.Details, putText); err != nil {
+			return err
 		}
 	}
 
 	for _, material := range item.Materials {
+		// A stopped job leaves the state of its materials to the run taking it over
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entry := materialEntry(material)
+		previous, seen := state.get(entry)
+		if seen && previous.Status == models.MaterialDownloadDone {
+			progress.materialFinished(item, material)
+			continue
+		}
+
 		switch material.Type {
 		case "youtubeVideo", "link":
-			if err := saveLinkToFile(item.DownloadFolderPath, material.URL); err != nil {
+			key := storage.Key(target.key, "links.txt")
+			if err := saveLinkToFile(ctx, target, material.URL); err != nil {
 				log.Printf("error saving link: %v", err)
+				state.failed(entry, material.Title, key, err)
+				progress.materialFailed(item, material, err)
+				continue
 			}
+			state.done(entry, material.Title, key, 0, "")
 		case "driveFile":
-			if err := saveDriveFile(item.DownloadFolderPath, token, material); err != nil {
+			fileName := item.FileNames[material.ID]
+			state.pending(entry, material.Title, storage.Key(target.key, fileName))
+
+			// A material seen by an earlier run may have left a partial file behind
+			onProgress := func(n int64) { progress.bytesWritten(item, material, n) }
+			key, download, err := saveDriveFile(ctx, target, fileName, ts, material, seen, onProgress)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
 				log.Printf("error saving drive file: %v", err)
+				state.failed(entry, material.Title, storage.Key(target.key, fileName), err)
+				progress.materialFailed(item, material, err)
+				continue
 			}
+			state.done(entry, material.Title, key, download.Size, download.MD5)
+		default:
+			continue
 		}
+		progress.materialFinished(item, material)
 	}
 	return nil
 }
 
-func saveItemText(FolderPath, text string) error {
-	filePath := filepath.Join(FolderPath, "Announcement.txt")
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
+// Writes the text or details file of an item with write, unless a previous run of the job already did it
+// A failure is recorded like a material's, so the job ends partial and reports the file
+func saveItemFile(ctx context.Context, item models.DownloadItem, target itemTarget, state *downloadState, part, fileName, text string,
+	write func(ctx context.Context, key, text string, modTime time.Time) error) error {
+	entry := itemFileEntry(item, part)
+	if state.isDone(entry) {
+		return nil
+	}
+
+	key := storage.Key(target.key, fileName)
+	if err := write(ctx, key, text, target.modTime); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("error saving %s of %q: %v", fileName, item.Title, err)
+		state.failed(entry, item.Title, key, err)
+		return nil
+	}
+	state.done(entry, item.Title, key, int64(len(text)), "")
+	return nil
+}
+
+func putText(ctx context.Context, key, text string, modTime time.Time) error {
+	return storage.PutString(ctx, utils.ContentStorage, key, text, modTime)
+}
+
+// Links are appended once per material, the download state skipping the ones already saved
+func saveLinkToFile(ctx context.Context, target itemTarget, link string) error {
+	return appendToFile(ctx, storage.Key(target.key, "links.txt"), link+"\n", target.modTime)
+}
+
+// Serializes the read-modify-write of appendToFile per file, storages have no append
+var appendLocks = newKeyedMutex()
+
+// Appends text to a stored file
+// A file shared by several items keeps the latest of their times
+func appendToFile(ctx context.Context, key, text string, modTime time.Time) error {
+	unlock := appendLocks.lock(key)
+	defer unlock()
+
+	existing, object, err := storage.GetString(ctx, utils.ContentStorage, key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
 		return err
 	}
-	defer file.Close()
-	_, err = file.WriteString(text)
-	return err
+	if object.ModTime.After(modTime) {
+		modTime = object.ModTime
+	}
+	return storage.PutString(ctx, utils.ContentStorage, key, existing+text, modTime)
 }
 
-func saveLinkToFile(folderPath, link string) error {
-	filePath := filepath.Join(folderPath, "links.txt")
-	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// A mutex per key, dropped once nobody holds or waits for it
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyLock)}
+}
+
+// Locks key and returns the function unlocking it
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// Downloads the Drive file of a material to the item's scratch folder, stores its Drive metadata,
+// then moves it to storage. Returns the key of the stored file.
+// A file that doesn't match its metadata is downloaded again from scratch, up to DOWNLOAD_MISMATCH_RETRIES times
+func saveDriveFile(ctx context.Context, target itemTarget, fileName string, ts oauth2.TokenSource, material models.Material, resume bool, onProgress func(n int64)) (string, *utils.DriveDownload, error) {
+	download, err := downloadDriveFile(ctx, filepath.Join(target.scratchDir, fileName), ts, material, resume, onProgress)
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+
+	// Names carry the export extension already, unless the file's type couldn't be told before downloading it
+	key := storage.Key(target.key, filepath.Base(download.Path))
+	if err := storage.PutFile(ctx, utils.ContentStorage, key, download.Path, target.modTime); err != nil {
+		return "", nil, fmt.Errorf("error storing %s: %w", key, err)
 	}
-	defer file.Close()
-	_, err = file.WriteString(link + "\n")
-	return err
+	return key, download, nil
 }
 
-func saveDriveFile(folderPath string, token *string, material models.Material) error {
-	filePath := filepath.Join(folderPath, utils.RemoveInvalidChars(material.Title))
+func downloadDriveFile(ctx context.Context, filePath string, ts oauth2.TokenSource, material models.Material, resume bool, onProgress func(n int64)) (*utils.DriveDownload, error) {
 	fileID, err := database.GetDriveFileID(material.ID)
 	if err != nil {
 		log.Printf("error retrieving fileID: %v", err)
-		return err
+		return nil, err
 	}
 
 	if fileID == "" {
 		fileID, err = database.GetDriveFileIDByTitle(material.Title)
 		if err != nil {
 			log.Printf("error retrieving fileID from material Title: %v", err)
-			return err
+			return nil, err
 		}
 	}
 
-	err = utils.DownloadDriveFile(token, fileID, filePath)
-	if err != nil {
-		log.Printf("error downloading material: %v", err)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating folder: %w", err)
 	}
 
-	return nil
+	retries, err := strconv.Atoi(os.Getenv("DOWNLOAD_MISMATCH_RETRIES"))
+	if err != nil || retries < 0 {
+		retries = 2
+	}
+
+	for attempt := 0; ; attempt++ {
+		download, err := utils.DownloadDriveFile(ctx, ts, fileID, filePath, resume, onProgress)
+		if download != nil {
+			metadata := download.Metadata
+			if err := database.UpdateDriveFileMetadata(fileID, metadata.MD5Checksum, metadata.Size, metadata.MimeType, metadata.ModifiedTime); err != nil {
+				log.Println(err)
+			}
+		}
+		if errors.Is(err, utils.ErrDownloadMismatch) && attempt < retries {
+			log.Printf("drive file %s of material %q: %v, downloading it again", fileID, material.Title, err)
+			resume = false
+			continue
+		}
+		if err != nil {
+			log.Printf("error downloading material: %v", err)
+			return nil, err
+		}
+		return download, nil
+	}
 }
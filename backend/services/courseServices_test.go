@@ -0,0 +1,100 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mspcix/google-classroom-course-downloader/models"
+	"github.com/mspcix/google-classroom-course-downloader/storage"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+// Local storage refusing to store files with the given name
+type failingStorage struct {
+	storage.Storage
+	fileName string
+}
+
+func (s failingStorage) Put(ctx context.Context, key string, r io.Reader, size int64, modTime time.Time) error {
+	if filepath.Base(key) == s.fileName {
+		return errors.New("disk full")
+	}
+	return s.Storage.Put(ctx, key, r, size, modTime)
+}
+
+func setupStorage(t *testing.T, failing string) {
+	t.Helper()
+	contentStorage := utils.ContentStorage
+	utils.ContentStorage = failingStorage{Storage: storage.NewLocal(t.TempDir()), fileName: failing}
+	t.Cleanup(func() { utils.ContentStorage = contentStorage })
+}
+
+// Saves the text and details of items as a run of the job would
+func saveItems(t *testing.T, jobID string, items []models.DownloadItem, target itemTarget) {
+	t.Helper()
+	state, err := loadDownloadState(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := getJobProgress(jobID)
+	t.Cleanup(func() { resetJobProgress(jobID) })
+	for _, item := range items {
+		if err := saveDownloadItem(context.Background(), item, target, nil, state, progress); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Announcements of the same day share their text file, each one is appended once however many runs the job takes
+func TestSaveItemTextAppendsEachItemOnce(t *testing.T) {
+	setupDB(t)
+	setupStorage(t, "")
+
+	target := itemTarget{scratchDir: t.TempDir(), key: "job/Algorithms/Announcements/01-02-2023"}
+	items := []models.DownloadItem{
+		{Title: "Announcement 01-02-2023", ItemType: "announcement", ItemID: 1, Text: "No class today\n"},
+		{Title: "Announcement 01-02-2023", ItemType: "announcement", ItemID: 2, Text: "No class today\n"},
+	}
+	saveItems(t, "job", items, target)
+	// A resumed run sees the texts already saved
+	saveItems(t, "job", items, target)
+
+	text, _, err := storage.GetString(context.Background(), utils.ContentStorage, storage.Key(target.key, "Announcement.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "No class today\nNo class today\n"; text != want {
+		t.Errorf("got %q, want %q", text, want)
+	}
+}
+
+// A text or details file that can't be stored is reported like a material, and makes the job partial
+func TestSaveItemFileRecordsFailures(t *testing.T) {
+	setupDB(t)
+	setupStorage(t, "Details.txt")
+
+	target := itemTarget{scratchDir: t.TempDir(), key: "job/Algorithms/Homework 1"}
+	saveItems(t, "job", []models.DownloadItem{
+		{Title: "Homework 1", ItemType: "courseWork", ItemID: 1, Text: "Sort the list\n", Details: "Due: 01-02-2023\n"},
+	}, target)
+
+	failed, err := countFailedMaterials("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed != 1 {
+		t.Errorf("%d failures recorded, want 1", failed)
+	}
+	report, err := GetJobReport(models.Job{ID: "job"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Done != 1 || len(report.Failures) != 1 || !strings.HasSuffix(report.Failures[0].FilePath, "Details.txt") {
+		t.Errorf("got report %+v, want the text done and the details failed", report)
+	}
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/models"
+)
+
+// Outcome of a discovery
+type DiscoveryResult struct {
+	Discovered int // Courses returned by Classroom
+	New        int // Courses inserted into the database
+	Synced     int // Courses already in the database brought up to date
+	SyncStats  database.SyncStats
+}
+
+// Retrieves the user's courses matching the filter from Classroom and enrolls the user in every one of them
+// New courses are inserted into the database with their content. Courses already there are synced
+// when the user joins them, or every time with sync
+func DiscoverCourses(ctx context.Context, gcuid string, filter CourseFilter, sync bool) (DiscoveryResult, error) {
+	var result DiscoveryResult
+	client := NewClassroomClient(UserTokenSource(gcuid))
+
+	courses, err := GetCoursesFromAPI(ctx, client, filter)
+	if err != nil {
+		return result, fmt.Errorf("error retrieving courses: %w", err)
+	}
+	result.Discovered = len(courses)
+
+	newCourses, existingCourses, err := SplitNewCourses(courses)
+	if err != nil {
+		return result, fmt.Errorf("error retrieving coursesId from the database: %w", err)
+	}
+
+	enrolledCoursesIDs, err := database.GetEnrolledCoursesGCIDs(gcuid)
+	if err != nil {
+		return result, fmt.Errorf("error retrieving enrolled courses from the database: %w", err)
+	}
+	enrolled := make(map[string]bool, len(enrolledCoursesIDs))
+	for _, id := range enrolledCoursesIDs {
+		enrolled[id] = true
+	}
+
+	// Courses already in the database are fetched again to be synced,
+	// always when the user joins them since their submissions aren't stored yet
+	coursesToSync := []models.Course{}
+	for _, course := range existingCourses {
+		if sync || !enrolled[course.GCID] {
+			coursesToSync = append(coursesToSync, course)
+		}
+	}
+	existingCourses = coursesToSync
+
+	if err := PopulateCoursesContent(ctx, client, newCourses); err != nil {
+		return result, fmt.Errorf("error retrieving new courses' content: %w", err)
+	}
+	if err := PopulateCoursesContent(ctx, client, existingCourses); err != nil {
+		return result, fmt.Errorf("error retrieving existing courses' content: %w", err)
+	}
+
+	if len(newCourses) != 0 {
+		log.Println("Inserting new courses into the database...")
+		start := time.Now()
+		if err := database.SaveCourses(newCourses, gcuid); err != nil {
+			return result, fmt.Errorf("error inserting courses into the database: %w", err)
+		}
+		log.Printf("Courses successfully inserted into the database in %v", time.Since(start))
+	} else {
+		log.Println("No new courses to insert into the database")
+	}
+	result.New = len(newCourses)
+
+	if len(existingCourses) != 0 {
+		log.Println("Syncing existing courses with the database...")
+		start := time.Now()
+		stats, err := SyncCourses(existingCourses, gcuid)
+		if err != nil {
+			return result, fmt.Errorf("error syncing courses with the database: %w", err)
+		}
+		log.Printf("%v course(s) synced in %v: %d inserted, %d updated, %d removed",
+			len(existingCourses), time.Since(start), stats.Inserted, stats.Updated, stats.Removed)
+		result.Synced = len(existingCourses)
+		result.SyncStats = stats
+	}
+
+	coursesIDs := make([]string, len(courses))
+	for i, course := range courses {
+		coursesIDs[i] = course.GCID
+	}
+	if err := database.EnrollUser(gcuid, coursesIDs); err != nil {
+		return result, fmt.Errorf("error enrolling user in courses: %w", err)
+	}
+
+	return result, nil
+}
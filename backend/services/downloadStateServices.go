@@ -0,0 +1,169 @@
+package services
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/models"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+// The download state of a job's materials and item files, loaded once per run and written through to the database
+type downloadState struct {
+	jobID   string
+	mu      sync.Mutex
+	entries map[downloadEntry]models.MaterialDownload
+}
+
+// Identifies a material, or the text or details file of an item, within a job
+type downloadEntry struct {
+	kind string
+	id   uint
+}
+
+func materialEntry(material models.Material) downloadEntry {
+	return downloadEntry{kind: models.MaterialDownloadKindMaterial, id: material.ID}
+}
+
+// part is models.ItemFileText or models.ItemFileDetails
+func itemFileEntry(item models.DownloadItem, part string) downloadEntry {
+	return downloadEntry{kind: item.ItemType + part, id: item.ItemID}
+}
+
+func loadDownloadState(jobID string) (*downloadState, error) {
+	states, err := database.GetMaterialDownloads(jobID)
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[downloadEntry]models.MaterialDownload, len(states))
+	for _, state := range states {
+		entries[downloadEntry{kind: state.Kind, id: state.MaterialID}] = state
+	}
+	return &downloadState{jobID: jobID, entries: entries}, nil
+}
+
+func (s *downloadState) get(entry downloadEntry) (models.MaterialDownload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.entries[entry]
+	return state, ok
+}
+
+// Reports whether the entry was saved by this run or an earlier one
+func (s *downloadState) isDone(entry downloadEntry) bool {
+	state, ok := s.get(entry)
+	return ok && state.Status == models.MaterialDownloadDone
+}
+
+// Records the state of an entry. A failure to persist it is only logged,
+// the entry will then be saved again if the job is resumed.
+func (s *downloadState) save(entry downloadEntry, state models.MaterialDownload) {
+	state.JobID = s.jobID
+	state.Kind = entry.kind
+	state.MaterialID = entry.id
+	state.UpdatedAt = time.Now()
+	if err := database.SaveMaterialDownload(&state); err != nil {
+		log.Printf("[job %s] %v", s.jobID, err)
+	}
+
+	s.mu.Lock()
+	s.entries[entry] = state
+	s.mu.Unlock()
+}
+
+// Reports whether every material recorded was saved
+func (s *downloadState) allDone() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, state := range s.entries {
+		if state.Status != models.MaterialDownloadDone {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *downloadState) pending(entry downloadEntry, title, filePath string) {
+	s.save(entry, models.MaterialDownload{
+		Title:    title,
+		Status:   models.MaterialDownloadPending,
+		FilePath: filePath,
+	})
+}
+
+func (s *downloadState) done(entry downloadEntry, title, filePath string, size int64, checksum string) {
+	s.save(entry, models.MaterialDownload{
+		Title:        title,
+		Status:       models.MaterialDownloadDone,
+		FilePath:     filePath,
+		BytesWritten: size,
+		Checksum:     checksum,
+	})
+}
+
+func (s *downloadState) failed(entry downloadEntry, title, filePath string, err error) {
+	s.save(entry, models.MaterialDownload{
+		Title:    title,
+		Status:   models.MaterialDownloadFailed,
+		FilePath: filePath,
+		Error:    err.Error(),
+	})
+}
+
+// Returns how many materials and item files of a job couldn't be saved
+func countFailedMaterials(jobID string) (int, error) {
+	materials, err := database.GetMaterialDownloads(jobID)
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	for _, material := range materials {
+		if material.Status == models.MaterialDownloadFailed {
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// Outcome of a job's materials, listing the ones that couldn't be saved
+type JobReport struct {
+	JobID    string                    `json:"jobId"`
+	Status   models.JobStatus          `json:"status"`
+	Done     int                       `json:"done"`
+	Pending  int                       `json:"pending"`
+	Failed   int                       `json:"failed"`
+	Failures []models.MaterialDownload `json:"failures"`
+}
+
+// Builds the report of a job from the recorded state of its materials
+func GetJobReport(job models.Job) (*JobReport, error) {
+	materials, err := database.GetMaterialDownloads(job.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Paths are reported relative to the job's folder, storage keys are internal to the server
+	keyPrefix := utils.JobKeyPrefix(job.UserGCID, job.ID)
+
+	report := JobReport{JobID: job.ID, Status: job.Status, Failures: []models.MaterialDownload{}}
+	for _, material := range materials {
+		material.FilePath = strings.TrimPrefix(material.FilePath, keyPrefix)
+		switch material.Status {
+		case models.MaterialDownloadDone:
+			report.Done++
+		case models.MaterialDownloadPending:
+			report.Pending++
+		case models.MaterialDownloadFailed:
+			report.Failed++
+			report.Failures = append(report.Failures, material)
+		}
+	}
+	sort.Slice(report.Failures, func(i, j int) bool {
+		return report.Failures[i].FilePath < report.Failures[j].FilePath
+	})
+	return &report, nil
+}
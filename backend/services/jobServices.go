@@ -0,0 +1,271 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/models"
+)
+
+var (
+	jobSlots     chan struct{}
+	jobSlotsOnce sync.Once
+
+	// IDs of the jobs queued or running in this process
+	activeJobs sync.Map
+
+	// Identifies this process in the leases of the jobs it runs
+	instanceID = newInstanceID()
+)
+
+// How long a job stays with its process without news from it. The lease is renewed
+// while the job is queued or running, a job whose lease expired is taken over by WatchInterruptedJobs.
+var jobLeaseTTL = time.Minute
+
+var ErrJobActive = errors.New("job is already queued or running")
+
+func newInstanceID() string {
+	hostname, _ := os.Hostname()
+	return hostname + "-" + uuid.NewString()[:8]
+}
+
+// Returns the semaphore limiting how many download jobs run at the same time
+func getJobSlots() chan struct{} {
+	jobSlotsOnce.Do(func() {
+		maxConcurrentJobs, err := strconv.Atoi(os.Getenv("MAX_CONCURRENT_JOBS"))
+		if err != nil || maxConcurrentJobs < 1 {
+			maxConcurrentJobs = 1
+		}
+		jobSlots = make(chan struct{}, maxConcurrentJobs)
+	})
+	return jobSlots
+}
+
+// Creates a download job for the given courses and runs it in the background.
+// Returns as soon as the job is queued.
+func StartDownloadJob(gcuid string, coursesIDs []string, layout string) (*models.Job, error) {
+	job, err := CreateDownloadJob(gcuid, coursesIDs, layout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tracked right away so clients subscribing before the job starts get its events
+	getJobProgress(job.ID)
+	go func() {
+		if err := claimJob(job.ID); err != nil {
+			log.Printf("[job %s] error claiming job: %v", job.ID, err)
+			resetJobProgress(job.ID)
+			return
+		}
+		runDownloadJob(*job)
+	}()
+
+	return job, nil
+}
+
+// Records a queued download job for the given courses without running it
+// The job is leased to this process, which is expected to run it
+func CreateDownloadJob(gcuid string, coursesIDs []string, layout string) (*models.Job, error) {
+	leaseExpiresAt := time.Now().Add(jobLeaseTTL)
+	job := models.Job{
+		ID:             uuid.NewString(),
+		UserGCID:       gcuid,
+		CoursesIDs:     coursesIDs,
+		Layout:         layout,
+		Status:         models.JobStatusQueued,
+		CreatedAt:      time.Now(),
+		Owner:          instanceID,
+		LeaseExpiresAt: &leaseExpiresAt,
+	}
+	if err := database.SaveJob(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Runs a download job once a slot is free and records its outcome
+// Blocks until the job is finished and returns its error, if any
+func RunDownloadJob(job models.Job) error {
+	if err := claimJob(job.ID); err != nil {
+		return err
+	}
+	return runDownloadJob(job)
+}
+
+// Marks the job as active in this process and takes its lease
+// Returns ErrJobActive if this process or another one is already running it
+func claimJob(jobID string) error {
+	if _, active := activeJobs.LoadOrStore(jobID, struct{}{}); active {
+		return ErrJobActive
+	}
+	claimed, err := database.ClaimJob(jobID, instanceID, jobLeaseTTL)
+	if err != nil || !claimed {
+		activeJobs.Delete(jobID)
+		if err != nil {
+			return err
+		}
+		return ErrJobActive
+	}
+	return nil
+}
+
+// Renews the lease of a claimed job until the returned function is called, which releases it
+// Calls lost if another process took the job over, the job must then stop
+func keepJobLease(jobID string, lost func()) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(jobLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				claimed, err := database.ClaimJob(jobID, instanceID, jobLeaseTTL)
+				if err != nil {
+					log.Printf("[job %s] error renewing lease: %v", jobID, err)
+				} else if !claimed {
+					log.Printf("[job %s] lease taken over by another process, stopping", jobID)
+					lost()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-stopped
+		if err := database.ReleaseJob(jobID, instanceID); err != nil {
+			log.Printf("[job %s] %v", jobID, err)
+		}
+	}
+}
+
+// Runs a claimed job, releasing it once finished
+// A job whose lease is taken over stops without recording an outcome, the process now running it will
+func runDownloadJob(job models.Job) error {
+	defer activeJobs.Delete(job.ID)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	releaseLease := keepJobLease(job.ID, cancel)
+	defer releaseLease()
+
+	// Tracked while queued so clients can follow the job from this process
+	progress := getJobProgress(job.ID)
+
+	slots := getJobSlots()
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		resetJobProgress(job.ID)
+		return ctx.Err()
+	}
+	defer func() { <-slots }()
+
+	log.Printf("[job %s] started", job.ID)
+	progress.jobStarted()
+	if err := database.UpdateJobStatus(job.ID, models.JobStatusRunning, ""); err != nil {
+		log.Printf("[job %s] error updating status: %v", job.ID, err)
+	}
+
+	start := time.Now()
+	status, errMsg := models.JobStatusDone, ""
+	err := DownloadCourses(ctx, job)
+	if ctx.Err() != nil {
+		// Subscribers are left to poll the status recorded by the new owner
+		resetJobProgress(job.ID)
+		log.Printf("[job %s] stopped after %v", job.ID, time.Since(start))
+		return ctx.Err()
+	}
+	if err != nil {
+		log.Printf("[job %s] error during download: %v", job.ID, err)
+		// The workspace is kept so the job can be resumed
+		status, errMsg = models.JobStatusFailed, err.Error()
+	} else if failed, err := countFailedMaterials(job.ID); err != nil {
+		log.Printf("[job %s] error counting failed materials: %v", job.ID, err)
+	} else if failed > 0 {
+		status, errMsg = models.JobStatusPartial, fmt.Sprintf("%d material(s) couldn't be downloaded", failed)
+	}
+
+	if err := database.UpdateJobStatus(job.ID, status, errMsg); err != nil {
+		log.Printf("[job %s] error updating status: %v", job.ID, err)
+	}
+	progress.jobFinished(job.ID, status, errMsg)
+	log.Printf("[job %s] %s in %v", job.ID, status, time.Since(start))
+	return err
+}
+
+// Runs a job that failed, ended partial or was interrupted again in the background.
+// Materials already saved are skipped, failed ones retried and partial files continued.
+// Returns ErrJobActive if this process or another one is running the job
+func ResumeDownloadJob(job models.Job) error {
+	if err := claimJob(job.ID); err != nil {
+		return err
+	}
+
+	resetJobProgress(job.ID)
+	if err := database.UpdateJobStatus(job.ID, models.JobStatusQueued, ""); err != nil {
+		database.ReleaseJob(job.ID, instanceID)
+		activeJobs.Delete(job.ID)
+		return err
+	}
+
+	go runDownloadJob(job)
+
+	return nil
+}
+
+// Resumes the jobs left queued or running by processes that stopped, whose lease expired
+// Jobs still leased by this process, another server or a CLI run are left to it
+func ResumeInterruptedJobs() error {
+	jobs, err := database.GetJobsByStatus(models.JobStatusQueued, models.JobStatusRunning)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.LeaseExpiresAt != nil && time.Now().Before(*job.LeaseExpiresAt) {
+			continue
+		}
+		err := ResumeDownloadJob(job)
+		switch {
+		case errors.Is(err, ErrJobActive):
+			// Claimed by another process since it was listed
+		case err != nil:
+			log.Printf("[job %s] error resuming job: %v", job.ID, err)
+		default:
+			log.Printf("[job %s] resumed interrupted job", job.ID)
+		}
+	}
+	return nil
+}
+
+// Resumes interrupted jobs now and then every jobLeaseTTL until ctx is done, so jobs still
+// leased by a previous run of the server, or by a process that stopped since, are picked up
+// once their lease expired
+func WatchInterruptedJobs(ctx context.Context) {
+	ticker := time.NewTicker(jobLeaseTTL)
+	defer ticker.Stop()
+	for {
+		if err := ResumeInterruptedJobs(); err != nil {
+			log.Println("Error resuming interrupted jobs:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+)
+
+func setupDB(t *testing.T) {
+	t.Helper()
+	db, err := database.Open(sqlite.Open(filepath.Join(t.TempDir(), "gcd.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+}
+
+// A job whose lease another process took over must stop rather than keep writing its files
+func TestKeepJobLeaseStopsWhenTakenOver(t *testing.T) {
+	setupDB(t)
+	leaseTTL := jobLeaseTTL
+	jobLeaseTTL = 300 * time.Millisecond
+	t.Cleanup(func() { jobLeaseTTL = leaseTTL })
+
+	job, err := CreateDownloadJob("user", []string{"course"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := make(chan struct{})
+	release := keepJobLease(job.ID, func() { close(lost) })
+	defer release()
+
+	// The lease is renewed past its TTL
+	time.Sleep(2 * jobLeaseTTL)
+	if claimed, err := database.ClaimJob(job.ID, "other-instance", time.Hour); err != nil || claimed {
+		t.Fatalf("job taken over while its lease was renewed: %v", err)
+	}
+	select {
+	case <-lost:
+		t.Fatal("lease reported lost while it was held")
+	default:
+	}
+
+	// Expire it as if the process had stalled, then let another process take it over
+	if err := database.ReleaseJob(job.ID, instanceID); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := database.ClaimJob(job.ID, "other-instance", time.Hour); err != nil || !claimed {
+		t.Fatalf("expired job not taken over: %v", err)
+	}
+	select {
+	case <-lost:
+	case <-time.After(2 * jobLeaseTTL):
+		t.Fatal("lease taken over without the job being stopped")
+	}
+
+	if leased, err := database.GetJobByID(job.ID); err != nil || leased.Owner != "other-instance" {
+		t.Errorf("lease of the new owner changed: %+v, %v", leased, err)
+	}
+}
@@ -0,0 +1,224 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mspcix/google-classroom-course-downloader/models"
+)
+
+const (
+	// Minimum delay between two bytesWritten events of the same job
+	bytesEventInterval = 250 * time.Millisecond
+	// How long the final state of a job is kept for late subscribers
+	finishedProgressTTL = time.Minute
+	// Events buffered per subscriber before new ones are dropped
+	subscriberBufferSize = 64
+)
+
+// Tracks the progress of a job and fans its events out to subscribers
+type jobProgress struct {
+	mu              sync.Mutex
+	snapshot        models.ProgressEvent
+	courseItemsLeft map[string]int
+	subscribers     map[chan models.ProgressEvent]struct{}
+	lastBytesEvent  time.Time
+	finished        bool
+}
+
+var (
+	progressesMu sync.Mutex
+	progresses   = make(map[string]*jobProgress)
+)
+
+// Returns the progress tracker of a job, creating it if needed
+func getJobProgress(jobID string) *jobProgress {
+	progressesMu.Lock()
+	defer progressesMu.Unlock()
+
+	p, ok := progresses[jobID]
+	if !ok {
+		p = &jobProgress{
+			snapshot:        models.ProgressEvent{JobID: jobID},
+			courseItemsLeft: make(map[string]int),
+			subscribers:     make(map[chan models.ProgressEvent]struct{}),
+		}
+		progresses[jobID] = p
+	}
+	return p
+}
+
+// Subscribes to the progress events of a job.
+// The first event is always a snapshot of the current counters.
+// The channel is closed once the job finishes or unsubscribe is called.
+// Returns false if the job isn't run by this process, its progress is then only known from its status.
+func SubscribeJobProgress(jobID string) (<-chan models.ProgressEvent, func(), bool) {
+	progressesMu.Lock()
+	p, ok := progresses[jobID]
+	progressesMu.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch := make(chan models.ProgressEvent, subscriberBufferSize)
+	snapshot := p.snapshot
+	snapshot.Type = models.ProgressSnapshot
+	ch <- snapshot
+
+	if p.finished {
+		close(ch)
+		return ch, func() {}, true
+	}
+
+	p.subscribers[ch] = struct{}{}
+	unsubscribe := func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if _, ok := p.subscribers[ch]; ok {
+			delete(p.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe, true
+}
+
+// Registers the download items of a job so the counters and course completion can be tracked
+func (p *jobProgress) setItems(items []models.DownloadItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.snapshot.TotalItems = len(items)
+	for _, item := range items {
+		p.courseItemsLeft[item.CourseID]++
+	}
+}
+
+func (p *jobProgress) jobStarted() {
+	p.publish(models.ProgressEvent{Type: models.ProgressJobStarted, Status: models.JobStatusRunning})
+}
+
+func (p *jobProgress) itemStarted(item models.DownloadItem) {
+	p.publish(itemEvent(models.ProgressItemStarted, item))
+}
+
+func (p *jobProgress) bytesWritten(item models.DownloadItem, material models.Material, n int64) {
+	event := itemEvent(models.ProgressBytesWritten, item)
+	event.Material = material.Title
+	event.BytesWritten = n
+	p.publish(event)
+}
+
+func (p *jobProgress) materialFinished(item models.DownloadItem, material models.Material) {
+	event := itemEvent(models.ProgressMaterialFinished, item)
+	event.Material = material.Title
+	p.publish(event)
+}
+
+func (p *jobProgress) materialFailed(item models.DownloadItem, material models.Material, err error) {
+	event := itemEvent(models.ProgressMaterialFailed, item)
+	event.Material = material.Title
+	event.Error = err.Error()
+	p.publish(event)
+}
+
+// Counts the item as finished and reports the course as finished with its last item
+func (p *jobProgress) itemFinished(item models.DownloadItem) {
+	p.mu.Lock()
+	p.snapshot.FinishedItems++
+	p.courseItemsLeft[item.CourseID]--
+	courseFinished := p.courseItemsLeft[item.CourseID] == 0
+	p.mu.Unlock()
+
+	if courseFinished {
+		p.publish(models.ProgressEvent{
+			Type:       models.ProgressCourseFinished,
+			CourseID:   item.CourseID,
+			CourseName: item.CourseName,
+		})
+	}
+}
+
+// Publishes the final event of the job and closes every subscription
+func (p *jobProgress) jobFinished(jobID string, status models.JobStatus, errMsg string) {
+	p.publish(models.ProgressEvent{Type: models.ProgressJobFinished, Status: status, Error: errMsg})
+
+	p.mu.Lock()
+	p.finished = true
+	for ch := range p.subscribers {
+		delete(p.subscribers, ch)
+		close(ch)
+	}
+	p.mu.Unlock()
+
+	// Keep the final state around for clients that subscribe right after the job ends
+	// unless the job was resumed in the meantime
+	time.AfterFunc(finishedProgressTTL, func() {
+		progressesMu.Lock()
+		if progresses[jobID] == p {
+			delete(progresses, jobID)
+		}
+		progressesMu.Unlock()
+	})
+}
+
+// Drops the progress of a finished job so it can be run again from zero
+// Subscribers of the old progress are closed as they would have been when it finished
+func resetJobProgress(jobID string) {
+	progressesMu.Lock()
+	p, ok := progresses[jobID]
+	delete(progresses, jobID)
+	progressesMu.Unlock()
+
+	if ok {
+		p.mu.Lock()
+		for ch := range p.subscribers {
+			delete(p.subscribers, ch)
+			close(ch)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Updates the counters and sends the event to every subscriber.
+// Slow subscribers miss events rather than blocking the downloads.
+func (p *jobProgress) publish(event models.ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.snapshot.BytesWritten += event.BytesWritten
+	if event.Status != "" {
+		p.snapshot.Status = event.Status
+		p.snapshot.Error = event.Error
+	}
+
+	if event.Type == models.ProgressBytesWritten {
+		if time.Since(p.lastBytesEvent) < bytesEventInterval {
+			return
+		}
+		p.lastBytesEvent = time.Now()
+	}
+
+	event.JobID = p.snapshot.JobID
+	event.TotalItems = p.snapshot.TotalItems
+	event.FinishedItems = p.snapshot.FinishedItems
+	event.BytesWritten = p.snapshot.BytesWritten
+
+	for ch := range p.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+func itemEvent(eventType models.ProgressEventType, item models.DownloadItem) models.ProgressEvent {
+	return models.ProgressEvent{
+		Type:       eventType,
+		CourseID:   item.CourseID,
+		CourseName: item.CourseName,
+		Item:       item.Title,
+	}
+}
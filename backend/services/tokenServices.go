@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"golang.org/x/oauth2"
+
+	"github.com/mspcix/google-classroom-course-downloader/database"
+	"github.com/mspcix/google-classroom-course-downloader/utils"
+)
+
+// A user's token, loaded from the database and refreshed when it expires
+// Refreshed tokens are saved back to the database so they survive restarts
+type userTokenSource struct {
+	gcuid string
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+var (
+	tokenSourcesMu sync.Mutex
+	tokenSources   = make(map[string]*userTokenSource)
+)
+
+// Returns the token source of a user
+// The same source is shared by every Classroom and Drive client of the user, so a token is only refreshed once
+func UserTokenSource(gcuid string) oauth2.TokenSource {
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+
+	ts, ok := tokenSources[gcuid]
+	if !ok {
+		ts = &userTokenSource{gcuid: gcuid}
+		tokenSources[gcuid] = ts
+	}
+	return ts
+}
+
+// Drops the cached token of a user, e.g. after they logged in again and got a new one
+func ResetUserTokenSource(gcuid string) {
+	tokenSourcesMu.Lock()
+	defer tokenSourcesMu.Unlock()
+
+	delete(tokenSources, gcuid)
+}
+
+// Returns a valid access token, refreshing it if needed
+func (ts *userTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token.Valid() {
+		return ts.token, nil
+	}
+
+	user, err := database.GetUserByGCUID(ts.gcuid)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving user's token: %w", err)
+	}
+	if user == nil {
+		return nil, fmt.Errorf("user %s not found", ts.gcuid)
+	}
+
+	stored := &oauth2.Token{
+		AccessToken:  string(user.Token),
+		TokenType:    "Bearer",
+		RefreshToken: string(user.RefreshToken),
+		Expiry:       user.TokenExpiry,
+	}
+	if stored.Valid() {
+		ts.token = stored
+		return ts.token, nil
+	}
+
+	if stored.RefreshToken == "" {
+		return nil, fmt.Errorf("token of user %s expired and can't be refreshed", ts.gcuid)
+	}
+
+	newToken, err := utils.OAuthConfig.TokenSource(context.Background(), &oauth2.Token{RefreshToken: stored.RefreshToken}).Token()
+	if err != nil {
+		return nil, fmt.Errorf("error refreshing token: %w", err)
+	}
+
+	if err := database.UpdateToken(ts.gcuid, newToken); err != nil {
+		return nil, err
+	}
+	if newToken.RefreshToken == "" {
+		newToken.RefreshToken = stored.RefreshToken
+	}
+
+	log.Printf("Token of user %s refreshed", ts.gcuid)
+	ts.token = newToken
+	return ts.token, nil
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stores objects as files under a root folder, the key being their path
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{root: filepath.Clean(root)}
+}
+
+func (l *Local) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, size int64, modTime time.Time) error {
+	filePath := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write next to the object first so readers never see it half written
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".put-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing %s: %w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return l.place(tmp.Name(), filePath, modTime)
+}
+
+// Renames the file into place, which is free when it's on the same file system
+func (l *Local) MoveFile(ctx context.Context, key, filePath string, modTime time.Time) error {
+	destPath := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := l.place(filePath, destPath, modTime); err == nil {
+		return nil
+	}
+
+	// Different file systems
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	err = l.Put(ctx, key, file, -1, modTime)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+func (l *Local) place(srcPath, destPath string, modTime time.Time) error {
+	if !modTime.IsZero() {
+		if err := os.Chtimes(srcPath, modTime, modTime); err != nil {
+			return err
+		}
+	}
+	return os.Rename(srcPath, destPath)
+}
+
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, Object, error) {
+	file, err := os.Open(l.path(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, Object{}, fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return nil, Object{}, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, Object{}, err
+	}
+	return file, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) List(ctx context.Context, prefix string) ([]Object, error) {
+	// Walk from the deepest folder the prefix names, then filter on the rest of it
+	dir := prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+	} else {
+		dir = ""
+	}
+
+	var objects []Object
+	err := filepath.WalkDir(l.path(dir), func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".put-") {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(l.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relPath)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", prefix, err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// Deletes the object and the folders it leaves empty
+func (l *Local) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(l.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(l.path(key)); strings.HasPrefix(dir, l.root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Local files are only reachable through the server
+func (l *Local) Presign(ctx context.Context, key string, expiry time.Duration, fileName string) (string, error) {
+	return "", ErrPresignUnsupported
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Metadata holding the modification time of an object, as S3 only keeps the upload time
+const modTimeMetadata = "X-Amz-Meta-Mtime"
+
+type S3Config struct {
+	Endpoint  string // Host and port, without scheme
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// Stores objects in a bucket of an S3-compatible service (AWS, MinIO, ...)
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3(config S3Config) (*S3, error) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating S3 client: %w", err)
+	}
+	return &S3{client: client, bucket: config.Bucket}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64, modTime time.Time) error {
+	opts := minio.PutObjectOptions{}
+	if size < 0 {
+		// Parts of unknown sized uploads are buffered, the default size fits 5TB objects
+		// Their chunked payload signing isn't understood by every S3-compatible service
+		opts.PartSize = 16 << 20
+		opts.DisableContentSha256 = true
+	}
+	if !modTime.IsZero() {
+		opts.UserMetadata = map[string]string{"Mtime": modTime.UTC().Format(time.RFC3339Nano)}
+	}
+	if _, err := s.client.PutObject(ctx, s.bucket, key, r, size, opts); err != nil {
+		return fmt.Errorf("error uploading %s: %w", key, err)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, Object, error) {
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, Object{}, s.wrapError(key, err)
+	}
+	// GetObject is lazy, Stat sends the request
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		return nil, Object{}, s.wrapError(key, err)
+	}
+	return object, toObject(info), nil
+}
+
+// Sizes and modification times come from the listing itself. The Mtime metadata is only listed by
+// services supporting metadata listings (MinIO), elsewhere objects get their upload time.
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	for listed := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true, WithMetadata: true}) {
+		if listed.Err != nil {
+			return nil, fmt.Errorf("error listing %s: %w", prefix, listed.Err)
+		}
+		objects = append(objects, toObject(listed))
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("error deleting %s: %w", key, err)
+	}
+	return nil
+}
+
+// The URL makes the browser save the object as fileName
+func (s *S3) Presign(ctx context.Context, key string, expiry time.Duration, fileName string) (string, error) {
+	params := url.Values{}
+	if fileName != "" {
+		params.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	}
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, expiry, params)
+	if err != nil {
+		return "", fmt.Errorf("error presigning %s: %w", key, err)
+	}
+	return u.String(), nil
+}
+
+func (s *S3) wrapError(key string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return fmt.Errorf("error reading %s: %w", key, err)
+}
+
+func toObject(info minio.ObjectInfo) Object {
+	modTime := info.LastModified
+	value := info.Metadata.Get(modTimeMetadata)
+	if value == "" {
+		value = info.UserMetadata[modTimeMetadata]
+	}
+	if value != "" {
+		if parsed, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			modTime = parsed
+		}
+	}
+	return Object{Key: info.Key, Size: info.Size, ModTime: modTime}
+}
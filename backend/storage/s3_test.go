@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const testBucket = "gcd-test"
+
+// In-memory stand-in for an S3-compatible service, answering the requests the S3 storage sends
+// Signatures aren't checked. Listings include user metadata, as MinIO does.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string]fakeS3Object
+	uploads  map[string]*fakeS3Upload
+	requests []string // Method and query of every request, in order
+}
+
+type fakeS3Object struct {
+	data     []byte
+	metadata http.Header // X-Amz-Meta-* headers
+	modTime  time.Time
+}
+
+type fakeS3Upload struct {
+	metadata http.Header
+	parts    map[int][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RawQuery)
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+testBucket), "/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, query.Get("prefix"), query.Get("metadata") == "true")
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID := strconv.Itoa(len(f.uploads) + 1)
+		f.uploads[uploadID] = &fakeS3Upload{metadata: amzMeta(r.Header), parts: make(map[int][]byte)}
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: testBucket, Key: key, UploadID: uploadID})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		upload.parts[partNumber], _ = io.ReadAll(r.Body)
+		w.Header().Set("ETag", fmt.Sprintf("%q", "part-"+strconv.Itoa(partNumber)))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		upload, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for number := range upload.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, upload.parts[number]...)
+		}
+		f.objects[key] = fakeS3Object{data: data, metadata: upload.metadata, modTime: time.Now()}
+		delete(f.uploads, query.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: testBucket, Key: key, ETag: `"object"`})
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		f.objects[key] = fakeS3Object{data: data, metadata: amzMeta(r.Header), modTime: time.Now()}
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := f.objects[key]
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		if disposition := query.Get("response-content-disposition"); disposition != "" {
+			w.Header().Set("Content-Disposition", disposition)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Last-Modified", object.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"object"`)
+		if r.Method == http.MethodGet {
+			w.Write(object.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// Listed as <X-Amz-Meta-Name>value</X-Amz-Meta-Name>
+type metadataEntry struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string, withMetadata bool) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		UserMetadata *struct {
+			Entries []metadataEntry
+		} `xml:",omitempty"`
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Name        string
+		Prefix      string
+		KeyCount    int
+		IsTruncated bool
+		Contents    []content
+	}{Name: testBucket, Prefix: prefix}
+
+	for key, object := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		c := content{Key: key, LastModified: object.modTime.UTC().Format(time.RFC3339Nano), ETag: `"object"`, Size: len(object.data)}
+		if withMetadata {
+			c.UserMetadata = &struct {
+				Entries []metadataEntry
+			}{}
+			for name := range object.metadata {
+				c.UserMetadata.Entries = append(c.UserMetadata.Entries, metadataEntry{XMLName: xml.Name{Local: name}, Value: object.metadata.Get(name)})
+			}
+		}
+		result.Contents = append(result.Contents, c)
+	}
+	result.KeyCount = len(result.Contents)
+	writeXML(w, result)
+}
+
+// Returns the user metadata headers of a request
+func amzMeta(header http.Header) http.Header {
+	metadata := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			metadata[name] = values
+		}
+	}
+	return metadata
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+// Returns the requests received since the last call
+func (f *fakeS3) takeRequests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := f.requests
+	f.requests = nil
+	return requests
+}
+
+// Returns an S3 storage backed by a fake service, over TLS like a production endpoint
+func newTestS3(t *testing.T) (*S3, *fakeS3, *http.Client) {
+	t.Helper()
+
+	fake := &fakeS3{objects: make(map[string]fakeS3Object), uploads: make(map[string]*fakeS3Upload)}
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+
+	endpoint, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:     credentials.NewStaticV4("access-key", "secret-key", ""),
+		Secure:    true,
+		Region:    "us-east-1",
+		Transport: server.Client().Transport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &S3{client: client, bucket: testBucket}, fake, server.Client()
+}
+
+func TestS3PutAndList(t *testing.T) {
+	s, fake, _ := newTestS3(t)
+	ctx := context.Background()
+
+	modTime := time.Date(2023, 2, 1, 10, 30, 0, 0, time.UTC)
+	if err := s.Put(ctx, "job/Algorithms/Syllabus.pdf", strings.NewReader("syllabus"), 8, modTime); err != nil {
+		t.Fatal(err)
+	}
+	// Archives are uploaded as they are built, without a known size
+	if err := s.Put(ctx, "job/Algorithms/Notes.txt", bytes.NewReader([]byte("notes")), -1, modTime.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(ctx, "other/File.txt", strings.NewReader("other"), 5, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, object, err := s.Get(ctx, "job/Algorithms/Notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != "notes" || !object.ModTime.Equal(modTime.Add(time.Hour)) {
+		t.Errorf("got %q modified %v: %v", data, object.ModTime, err)
+	}
+
+	fake.takeRequests()
+	objects, err := s.List(ctx, "job/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Object{
+		{Key: "job/Algorithms/Notes.txt", Size: 5, ModTime: modTime.Add(time.Hour)},
+		{Key: "job/Algorithms/Syllabus.pdf", Size: 8, ModTime: modTime},
+	}
+	if len(objects) != len(want) {
+		t.Fatalf("listed %+v, want %+v", objects, want)
+	}
+	for i := range want {
+		if objects[i].Key != want[i].Key || objects[i].Size != want[i].Size || !objects[i].ModTime.Equal(want[i].ModTime) {
+			t.Errorf("listed %+v, want %+v", objects[i], want[i])
+		}
+	}
+	if requests := fake.takeRequests(); len(requests) != 1 {
+		t.Errorf("listing sent %d requests, want 1: %v", len(requests), requests)
+	}
+}
+
+func TestS3DeletePrefix(t *testing.T) {
+	s, _, _ := newTestS3(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"job/a.txt", "job/folder/b.txt", "jobs/c.txt"} {
+		if err := s.Put(ctx, key, strings.NewReader(key), int64(len(key)), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := DeletePrefix(ctx, s, "job/"); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "jobs/c.txt" {
+		t.Errorf("left %+v, want jobs/c.txt only", objects)
+	}
+	if _, _, err := s.Get(ctx, "job/a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v for a deleted object, want ErrNotFound", err)
+	}
+}
+
+func TestS3Presign(t *testing.T) {
+	s, _, client := newTestS3(t)
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "archives/user/job.zip", strings.NewReader("archive"), 7, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	presigned, err := s.Presign(ctx, "archives/user/job.zip", 15*time.Minute, "GCD_Classroom.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("X-Amz-Signature") == "" || query.Get("X-Amz-Expires") != "900" {
+		t.Errorf("URL isn't presigned for 15 minutes: %s", presigned)
+	}
+
+	resp, err := client.Get(presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(data) != "archive" {
+		t.Fatalf("got status %d and %q", resp.StatusCode, data)
+	}
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != `attachment; filename="GCD_Classroom.zip"` {
+		t.Errorf("archive served as %q", disposition)
+	}
+}
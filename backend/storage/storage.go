@@ -0,0 +1,138 @@
+// Package storage keeps the downloaded course content, on the local file system or in an S3-compatible bucket.
+// Content is addressed by slash-separated keys, e.g. <gcuid>/<jobID>/<course>/<topic>/<file>.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound            = errors.New("object not found")
+	ErrPresignUnsupported  = errors.New("storage can't presign urls")
+	errInvalidStorageKind  = errors.New("invalid STORAGE_BACKEND")
+	errMissingS3Parameters = errors.New("S3_ENDPOINT and S3_BUCKET are required by the s3 storage")
+)
+
+// A stored file
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time // Modification time given when the object was put
+}
+
+type Storage interface {
+	// Stores the content of r under key, replacing what's there
+	Put(ctx context.Context, key string, r io.Reader, size int64, modTime time.Time) error
+	// Opens the object under key. Returns ErrNotFound if there's none.
+	Get(ctx context.Context, key string) (io.ReadCloser, Object, error)
+	// Lists the objects whose key starts with prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// Deletes the object under key, if any
+	Delete(ctx context.Context, key string) error
+	// Returns a URL the object can be downloaded from without credentials until expiry
+	// Returns ErrPresignUnsupported if the storage isn't reachable by clients
+	Presign(ctx context.Context, key string, expiry time.Duration, fileName string) (string, error)
+}
+
+// Storages that can take over a local file instead of copying it
+type fileMover interface {
+	MoveFile(ctx context.Context, key, filePath string, modTime time.Time) error
+}
+
+// Builds the storage chosen by STORAGE_BACKEND, local (the default) or s3
+// Local content goes under localRoot
+func FromEnv(localRoot string) (Storage, error) {
+	switch kind := os.Getenv("STORAGE_BACKEND"); kind {
+	case "", "local":
+		return NewLocal(localRoot), nil
+	case "s3":
+		config := S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			Region:    os.Getenv("S3_REGION"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			UseSSL:    os.Getenv("S3_USE_SSL") != "false",
+		}
+		if config.Endpoint == "" || config.Bucket == "" {
+			return nil, errMissingS3Parameters
+		}
+		return NewS3(config)
+	default:
+		return nil, fmt.Errorf("%w %q, expected local or s3", errInvalidStorageKind, kind)
+	}
+}
+
+// Stores a local file under key. The file is removed once stored.
+func PutFile(ctx context.Context, s Storage, key, filePath string, modTime time.Time) error {
+	if mover, ok := s.(fileMover); ok {
+		return mover.MoveFile(ctx, key, filePath, modTime)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = s.Put(ctx, key, file, info.Size(), modTime)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+// Stores a string under key
+func PutString(ctx context.Context, s Storage, key, content string, modTime time.Time) error {
+	return s.Put(ctx, key, strings.NewReader(content), int64(len(content)), modTime)
+}
+
+// Reads the whole object under key
+func GetString(ctx context.Context, s Storage, key string) (string, Object, error) {
+	r, object, err := s.Get(ctx, key)
+	if err != nil {
+		return "", object, err
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return "", object, fmt.Errorf("error reading %s: %w", key, err)
+	}
+	return string(content), object, nil
+}
+
+// Deletes every object whose key starts with prefix
+func DeletePrefix(ctx context.Context, s Storage, prefix string) error {
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if err := s.Delete(ctx, object.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Joins key parts with slashes, ignoring empty ones
+func Key(parts ...string) string {
+	nonEmpty := parts[:0:0]
+	for _, part := range parts {
+		if part = strings.Trim(part, "/"); part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "/")
+}
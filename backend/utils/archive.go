@@ -0,0 +1,295 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/mspcix/google-classroom-course-downloader/storage"
+)
+
+// Writes stored files as a single archive
+type Archiver interface {
+	// Extension of the archive files, with its leading dot
+	Extension() string
+	ContentType() string
+	// Writes the archive of the objects under prefix to w as they are read, named after their key without the prefix
+	Archive(ctx context.Context, w io.Writer, s storage.Storage, prefix string) error
+}
+
+// Prefix of the archives stored for clients to download them from storage
+const ArchivesKeyPrefix = "archives/"
+
+// How long a stored archive is kept once its link expired, for the downloads started in time to finish
+const archiveGracePeriod = time.Hour
+
+// Archivers by the name of their format, as given in the format query parameter
+var Archivers = map[string]Archiver{
+	"zip":     zipArchiver{},
+	"tar.gz":  tarGzArchiver{},
+	"tar.zst": tarZstArchiver{},
+}
+
+type zipArchiver struct{}
+
+func (zipArchiver) Extension() string   { return ".zip" }
+func (zipArchiver) ContentType() string { return "application/zip" }
+
+func (zipArchiver) Archive(ctx context.Context, w io.Writer, s storage.Storage, prefix string) error {
+	return zipObjects(ctx, w, s, prefix)
+}
+
+type tarGzArchiver struct{}
+
+func (tarGzArchiver) Extension() string   { return ".tar.gz" }
+func (tarGzArchiver) ContentType() string { return "application/gzip" }
+
+func (tarGzArchiver) Archive(ctx context.Context, w io.Writer, s storage.Storage, prefix string) error {
+	gzipWriter := gzip.NewWriter(w)
+	if err := tarObjects(ctx, gzipWriter, s, prefix); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+type tarZstArchiver struct{}
+
+func (tarZstArchiver) Extension() string   { return ".tar.zst" }
+func (tarZstArchiver) ContentType() string { return "application/zstd" }
+
+func (tarZstArchiver) Archive(ctx context.Context, w io.Writer, s storage.Storage, prefix string) error {
+	zstdWriter, err := zstd.NewWriter(w)
+	if err != nil {
+		return fmt.Errorf("error creating zstd writer: %w", err)
+	}
+	if err := tarObjects(ctx, zstdWriter, s, prefix); err != nil {
+		zstdWriter.Close()
+		return err
+	}
+	return zstdWriter.Close()
+}
+
+// A folder implied by the keys of stored files, with the modification time of its latest file
+type archiveFolder struct {
+	name    string
+	modTime time.Time
+}
+
+// Lists the objects under prefix along with the folders holding them, parents first
+func listArchive(ctx context.Context, s storage.Storage, prefix string) ([]storage.Object, []archiveFolder, error) {
+	objects, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	modTimes := make(map[string]time.Time)
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, prefix)
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if object.ModTime.After(modTimes[dir]) {
+				modTimes[dir] = object.ModTime
+			}
+		}
+	}
+
+	folders := make([]archiveFolder, 0, len(modTimes))
+	for name, modTime := range modTimes {
+		folders = append(folders, archiveFolder{name: name, modTime: modTime})
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].name < folders[j].name })
+	return objects, folders, nil
+}
+
+// Copies a stored object to w
+func copyObject(ctx context.Context, w io.Writer, s storage.Storage, key string) error {
+	r, _, err := s.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// Writes a zip archive of the objects under prefix to w, without a temporary file
+// Files whose extension is in StoredExtensions are stored as they are, the others deflated
+func zipObjects(ctx context.Context, w io.Writer, s storage.Storage, prefix string) error {
+	objects, _, err := listArchive(ctx, s, prefix)
+	if err != nil {
+		return err
+	}
+
+	zipWriter := zip.NewWriter(w)
+	for _, object := range objects {
+		header := &zip.FileHeader{
+			Name:     strings.TrimPrefix(object.Key, prefix),
+			Method:   zip.Deflate,
+			Modified: object.ModTime,
+		}
+		header.SetMode(0644)
+		if StoredExtensions[strings.ToLower(path.Ext(object.Key))] {
+			header.Method = zip.Store
+		}
+
+		entry, err := zipWriter.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyObject(ctx, entry, s, object.Key); err != nil {
+			return err
+		}
+	}
+
+	return zipWriter.Close()
+}
+
+// Writes a tar archive of the objects under prefix to w, keeping the modification times of files and folders
+func tarObjects(ctx context.Context, w io.Writer, s storage.Storage, prefix string) error {
+	objects, folders, err := listArchive(ctx, s, prefix)
+	if err != nil {
+		return err
+	}
+
+	// PAX keeps non-ASCII names and sub-second times
+	tarWriter := tar.NewWriter(w)
+	for _, folder := range folders {
+		header := &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     folder.name + "/",
+			Mode:     0755,
+			ModTime:  folder.modTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+
+	for _, object := range objects {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(object.Key, prefix),
+			Mode:     0644,
+			Size:     object.Size,
+			ModTime:  object.ModTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyObject(ctx, tarWriter, s, object.Key); err != nil {
+			return err
+		}
+	}
+
+	return tarWriter.Close()
+}
+
+// Copies the objects under prefix into a folder, skipping the files already there with the same size and modification time
+// Files only present in the destination are kept, folders get the time of their latest file
+// Returns the number of files copied and skipped
+func SyncToFolder(ctx context.Context, s storage.Storage, prefix, destDir string) (copied, skipped int, err error) {
+	objects, folders, err := listArchive(ctx, s, prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, object := range objects {
+		destPath := filepath.Join(destDir, filepath.FromSlash(strings.TrimPrefix(object.Key, prefix)))
+		if destInfo, err := os.Stat(destPath); err == nil && destInfo.Size() == object.Size && destInfo.ModTime().Equal(object.ModTime) {
+			skipped++
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+			return copied, skipped, err
+		}
+		if err := copyObjectToFile(ctx, s, object.Key, destPath); err != nil {
+			return copied, skipped, err
+		}
+		if err := os.Chtimes(destPath, object.ModTime, object.ModTime); err != nil {
+			return copied, skipped, err
+		}
+		copied++
+	}
+
+	for _, folder := range folders {
+		folderPath := filepath.Join(destDir, filepath.FromSlash(folder.name))
+		if err := os.Chtimes(folderPath, folder.modTime, folder.modTime); err != nil {
+			return copied, skipped, err
+		}
+	}
+	return copied, skipped, nil
+}
+
+func copyObjectToFile(ctx context.Context, s storage.Storage, key, destPath string) error {
+	// Write to a temporary file first so an interrupted copy doesn't look up to date
+	tmpPath := destPath + ".part"
+	dest, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := copyObject(ctx, dest, s, key); err != nil {
+		dest.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, destPath)
+}
+
+// Returns the path of the folder the jobs of a user are synced to, or an empty string if folder sync is disabled
+func SyncFolderPath(gcuid string) string {
+	syncFolder := os.Getenv("SYNC_FOLDER_PATH")
+	if syncFolder == "" {
+		return ""
+	}
+	return filepath.Join(syncFolder, filepath.Base(gcuid))
+}
+
+// Deletes the stored archives whose links expired
+func RemoveExpiredArchives(ctx context.Context, s storage.Storage) error {
+	objects, err := s.List(ctx, ArchivesKeyPrefix)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if time.Since(object.ModTime) > PresignExpiry+archiveGracePeriod {
+			if err := s.Delete(ctx, object.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Removes the expired archives now and then every PresignExpiry, until ctx is done
+func CleanArchives(ctx context.Context, s storage.Storage) {
+	ticker := time.NewTicker(PresignExpiry)
+	defer ticker.Stop()
+	for {
+		if err := RemoveExpiredArchives(ctx, s); err != nil {
+			log.Println("Error removing expired archives:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
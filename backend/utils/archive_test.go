@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mspcix/google-classroom-course-downloader/storage"
+)
+
+func TestRemoveExpiredArchives(t *testing.T) {
+	s := storage.NewLocal(t.TempDir())
+	ctx := context.Background()
+
+	stored := map[string]time.Time{
+		"archives/user/expired.zip": time.Now().Add(-PresignExpiry - archiveGracePeriod - time.Minute),
+		"archives/user/recent.zip":  time.Now().Add(-PresignExpiry),
+		"user/job/old.pdf":          time.Now().Add(-PresignExpiry - archiveGracePeriod - time.Minute),
+	}
+	for key, modTime := range stored {
+		if err := s.Put(ctx, key, strings.NewReader(key), int64(len(key)), modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := RemoveExpiredArchives(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	if strings.Join(keys, ",") != "archives/user/recent.zip,user/job/old.pdf" {
+		t.Errorf("left %v, want the recent archive and the job file", keys)
+	}
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const googleWorkspaceMimeTypePrefix = "application/vnd.google-apps."
+
+// A format a Google Workspace file can be exported to
+type ExportFormat struct {
+	MimeType  string
+	Extension string
+}
+
+// A Google Workspace file type, the env variable choosing its export format and the formats it supports
+type workspaceType struct {
+	mimeType      string
+	envVar        string
+	defaultFormat string
+	formats       map[string]ExportFormat
+}
+
+var workspaceTypes = []workspaceType{
+	{
+		mimeType:      googleWorkspaceMimeTypePrefix + "document",
+		envVar:        "EXPORT_FORMAT_DOCS",
+		defaultFormat: "pdf",
+		formats: map[string]ExportFormat{
+			"pdf":  {"application/pdf", ".pdf"},
+			"docx": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx"},
+			"odt":  {"application/vnd.oasis.opendocument.text", ".odt"},
+			"txt":  {"text/plain", ".txt"},
+		},
+	},
+	{
+		mimeType:      googleWorkspaceMimeTypePrefix + "spreadsheet",
+		envVar:        "EXPORT_FORMAT_SHEETS",
+		defaultFormat: "xlsx",
+		formats: map[string]ExportFormat{
+			"xlsx": {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", ".xlsx"},
+			"csv":  {"text/csv", ".csv"},
+			"ods":  {"application/vnd.oasis.opendocument.spreadsheet", ".ods"},
+			"pdf":  {"application/pdf", ".pdf"},
+		},
+	},
+	{
+		mimeType:      googleWorkspaceMimeTypePrefix + "presentation",
+		envVar:        "EXPORT_FORMAT_SLIDES",
+		defaultFormat: "pdf",
+		formats: map[string]ExportFormat{
+			"pdf":  {"application/pdf", ".pdf"},
+			"pptx": {"application/vnd.openxmlformats-officedocument.presentationml.presentation", ".pptx"},
+			"odp":  {"application/vnd.oasis.opendocument.presentation", ".odp"},
+		},
+	},
+	{
+		mimeType:      googleWorkspaceMimeTypePrefix + "drawing",
+		envVar:        "EXPORT_FORMAT_DRAWINGS",
+		defaultFormat: "pdf",
+		formats: map[string]ExportFormat{
+			"pdf": {"application/pdf", ".pdf"},
+			"png": {"image/png", ".png"},
+			"jpg": {"image/jpeg", ".jpg"},
+			"svg": {"image/svg+xml", ".svg"},
+		},
+	},
+}
+
+// Export format of each Google Workspace mime type, filled by InitExportFormats
+var ExportFormats = map[string]ExportFormat{}
+
+// Reads the export format of every Google Workspace file type from the environment
+func InitExportFormats() error {
+	for _, wt := range workspaceTypes {
+		name := strings.ToLower(os.Getenv(wt.envVar))
+		if name == "" {
+			name = wt.defaultFormat
+		}
+
+		format, ok := wt.formats[name]
+		if !ok {
+			return fmt.Errorf("unsupported export format %q for %s", name, wt.envVar)
+		}
+		ExportFormats[wt.mimeType] = format
+	}
+	return nil
+}
+
+// Reports whether a Drive mime type is a Google Workspace type (Docs, Sheets, Forms, folders...)
+func IsGoogleWorkspaceMimeType(mimeType string) bool {
+	return strings.HasPrefix(mimeType, googleWorkspaceMimeTypePrefix)
+}
+
+// Appends the extension to the file path unless it already ends with it
+func WithExtension(filePath, extension string) string {
+	if strings.HasSuffix(strings.ToLower(filePath), extension) {
+		return filePath
+	}
+	return filePath + extension
+}
+
+// Google Workspace types by the first element of the path of their links on docs.google.com
+var workspaceLinkTypes = map[string]string{
+	"document":     googleWorkspaceMimeTypePrefix + "document",
+	"spreadsheets": googleWorkspaceMimeTypePrefix + "spreadsheet",
+	"presentation": googleWorkspaceMimeTypePrefix + "presentation",
+	"drawings":     googleWorkspaceMimeTypePrefix + "drawing",
+}
+
+// Returns the name a Drive file is saved under, exported files getting the extension of their format
+// Drive's mime type is only known once the file was downloaded, until then the type is told by the
+// link Classroom gives for the file
+func ExportedName(name, mimeType, link string) string {
+	if mimeType == "" {
+		if u, err := url.Parse(link); err == nil && u.Host == "docs.google.com" {
+			mimeType = workspaceLinkTypes[strings.Split(strings.TrimPrefix(u.Path, "/"), "/")[0]]
+		}
+	}
+	if format, ok := ExportFormats[mimeType]; ok {
+		return WithExtension(name, format.Extension)
+	}
+	return name
+}
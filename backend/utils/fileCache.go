@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Cache of downloaded Drive files shared by every user and job, set by InitFileCache
+// Nil when FILE_CACHE_PATH isn't set
+var DriveFileCache *FileCache
+
+// Content-addressed cache of files on disk, evicting the least recently used ones past its size cap
+// Entries are copied in and out rather than hardlinked: storage sets the modification time of the files
+// it's given, which would otherwise change the entry and every other file sharing it.
+// The cache doesn't check who may read an entry: callers must only look it up once the user's access
+// to the file has been checked.
+type FileCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	lru     *list.List // Of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	size    int64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// Sets up DriveFileCache from FILE_CACHE_PATH and FILE_CACHE_MAX_MB
+func InitFileCache() error {
+	dir := os.Getenv("FILE_CACHE_PATH")
+	if dir == "" {
+		DriveFileCache = nil
+		return nil
+	}
+
+	maxSizeMB := int64(1024)
+	if value := os.Getenv("FILE_CACHE_MAX_MB"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			return fmt.Errorf("invalid FILE_CACHE_MAX_MB %q", value)
+		}
+		maxSizeMB = parsed
+	}
+
+	cache, err := NewFileCache(dir, maxSizeMB*1024*1024)
+	if err != nil {
+		return err
+	}
+	DriveFileCache = cache
+	return nil
+}
+
+// Opens the cache in dir, picking up the entries left by a previous run
+// Their last use isn't known, so they are ordered by modification time
+func NewFileCache(dir string, maxSize int64) (*FileCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating file cache folder: %w", err)
+	}
+
+	type existing struct {
+		key  string
+		info os.FileInfo
+	}
+	var found []existing
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		// Leftovers of an interrupted insert
+		if strings.Contains(info.Name(), ".tmp") {
+			return os.Remove(path)
+		}
+		found = append(found, existing{key: info.Name(), info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading file cache folder: %w", err)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].info.ModTime().Before(found[j].info.ModTime())
+	})
+
+	c := &FileCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range found {
+		c.entries[f.key] = c.lru.PushFront(&cacheEntry{key: f.key, size: f.info.Size()})
+		c.size += f.info.Size()
+	}
+	c.evict()
+
+	return c, nil
+}
+
+// Builds a cache key from the values identifying a version of a file
+func CacheKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *FileCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Puts the cached file at destPath, replacing what's there
+// Reports false if the key isn't cached
+func (c *FileCache) Get(key, destPath string) (bool, error) {
+	c.mu.Lock()
+	element, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	if err := os.Remove(destPath); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := copyFile(c.path(key), destPath); err != nil {
+		if os.IsNotExist(err) {
+			// Evicted in the meantime
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Adds the file at srcPath to the cache under key, then evicts entries past the size cap
+func (c *FileCache) Put(key, srcPath string) error {
+	c.mu.Lock()
+	_, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	// Concurrent puts of the same key each write their own temporary file, the first one to be added wins
+	entryPath := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(entryPath), os.ModePerm); err != nil {
+		return err
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmpPath := entryPath + ".tmp" + hex.EncodeToString(suffix)
+	if err := copyFile(srcPath, tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// The entry is added along with its file, so an eviction can't remove the file of an entry still listed
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return os.Remove(tmpPath)
+	}
+	if err := os.Rename(tmpPath, entryPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: info.Size()})
+	c.size += info.Size()
+	c.evict()
+	return nil
+}
+
+// Removes the least recently used entries until the cache fits its cap
+func (c *FileCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		entry := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		if err := os.Remove(c.path(entry.key)); err != nil && !os.IsNotExist(err) {
+			log.Printf("[cache] error evicting %s: %v", entry.key, err)
+		}
+	}
+}
+
+func copyFile(srcPath, destPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dest, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, src); err != nil {
+		dest.Close()
+		return err
+	}
+	return dest.Close()
+}
@@ -0,0 +1,263 @@
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Writes a file of the given content in dir and returns its path
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func cached(t *testing.T, cache *FileCache, key string) bool {
+	t.Helper()
+	ok, err := cache.Get(key, filepath.Join(t.TempDir(), "dest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+// Storage sets the modification time of the files it's given, which mustn't reach the cache
+func TestFileCacheEntriesAreIndependentCopies(t *testing.T) {
+	cache, err := NewFileCache(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	srcPath, destPath := filepath.Join(dir, "src"), filepath.Join(dir, "dest")
+	if err := os.WriteFile(srcPath, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	key := CacheKey("file", "v1")
+	if err := cache.Put(key, srcPath); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := os.Stat(cache.path(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := cache.Get(key, destPath); err != nil || !ok {
+		t.Fatalf("cached file not found: %v", err)
+	}
+	past := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, path := range []string{srcPath, destPath} {
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.SameFile(info, entry) {
+			t.Errorf("%s shares its inode with the cache entry", filepath.Base(path))
+		}
+	}
+
+	after, err := os.Stat(cache.path(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.ModTime().Equal(entry.ModTime()) {
+		t.Errorf("cache entry modification time changed from %v to %v", entry.ModTime(), after.ModTime())
+	}
+}
+
+// Past its size cap, the cache drops the entries used the longest time ago
+func TestFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, err := NewFileCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	keys := []string{CacheKey("a"), CacheKey("b"), CacheKey("c")}
+	for i, key := range keys[:2] {
+		if err := cache.Put(key, writeFile(t, dir, strings.Repeat("x", i+1), "12345")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a is used after b, which is then the least recently used
+	if !cached(t, cache, keys[0]) {
+		t.Fatal("a evicted before the cache was full")
+	}
+	if err := cache.Put(keys[2], writeFile(t, dir, "c", "12345")); err != nil {
+		t.Fatal(err)
+	}
+
+	if cached(t, cache, keys[1]) {
+		t.Error("least recently used entry kept past the size cap")
+	}
+	if _, err := os.Stat(cache.path(keys[1])); !os.IsNotExist(err) {
+		t.Errorf("file of the evicted entry left behind: %v", err)
+	}
+	for _, key := range []string{keys[0], keys[2]} {
+		if !cached(t, cache, key) {
+			t.Errorf("entry %s evicted", key[:8])
+		}
+	}
+	if cache.size != 10 {
+		t.Errorf("cache size is %d, want 10", cache.size)
+	}
+}
+
+// A new cache picks up the entries of the previous run and drops its leftover temporary files
+func TestNewFileCacheReloadsEntries(t *testing.T) {
+	cacheDir := t.TempDir()
+	cache, err := NewFileCache(cacheDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	older, newer := CacheKey("older"), CacheKey("newer")
+	for _, key := range []string{older, newer} {
+		if err := cache.Put(key, writeFile(t, dir, key, "12345")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(cache.path(older), past, past); err != nil {
+		t.Fatal(err)
+	}
+	leftover := cache.path(newer) + ".tmp0123456789abcdef"
+	if err := os.WriteFile(leftover, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopened with room for a single entry, the most recently modified one is kept
+	reloaded, err := NewFileCache(cacheDir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached(t, reloaded, newer) {
+		t.Error("entry of the previous run not reloaded")
+	}
+	if cached(t, reloaded, older) {
+		t.Error("older entry kept past the size cap")
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("temporary file of an interrupted put left behind: %v", err)
+	}
+	if reloaded.size != 5 {
+		t.Errorf("reloaded cache size is %d, want 5", reloaded.size)
+	}
+}
+
+// Every entry listed by the cache has its file, however puts and evictions interleave
+func TestFileCacheConcurrentPuts(t *testing.T) {
+	cache, err := NewFileCache(t.TempDir(), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			srcPath := writeFile(t, dir, strings.Repeat("x", i+1), "12345")
+			for j := 0; j < 20; j++ {
+				if err := cache.Put(CacheKey(string(rune('a'+(i+j)%10))), srcPath); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	var size int64
+	for key, element := range cache.entries {
+		if _, err := os.Stat(cache.path(key)); err != nil {
+			t.Errorf("entry %s listed without its file: %v", key[:8], err)
+		}
+		size += element.Value.(*cacheEntry).size
+	}
+	if size != cache.size || size > cache.maxSize {
+		t.Errorf("cache holds %d bytes and counts %d, with a cap of %d", size, cache.size, cache.maxSize)
+	}
+}
+
+// A cached file is only served once Drive has shown, with the user's own token, that they can read it
+func TestDownloadDriveFileChecksAccessBeforeCache(t *testing.T) {
+	const content = "syllabus"
+	sum := md5.Sum([]byte(content))
+	var mu sync.Mutex
+	var contentRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-a" {
+			http.Error(w, `{"error": {"code": 404, "message": "File not found"}}`, http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("alt") == "media" {
+			mu.Lock()
+			contentRequests++
+			mu.Unlock()
+			w.Write([]byte(content))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "file-syllabus", "name": "Syllabus.pdf", "mimeType": "application/pdf", "size": "8", "md5Checksum": "` +
+			hex.EncodeToString(sum[:]) + `", "modifiedTime": "2023-01-02T10:00:00Z"}`))
+	}))
+	defer server.Close()
+
+	apiURL, fileCache := DriveAPIURL, DriveFileCache
+	t.Cleanup(func() { DriveAPIURL, DriveFileCache = apiURL, fileCache })
+	DriveAPIURL = server.URL
+	var err error
+	if DriveFileCache, err = NewFileCache(t.TempDir(), 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(token, name string) (string, error) {
+		path := filepath.Join(t.TempDir(), name)
+		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+		if _, err := DownloadDriveFile(context.Background(), ts, "file-syllabus", path, false, nil); err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(path)
+		return string(data), err
+	}
+
+	// A downloads the file, which is cached, then gets it from the cache
+	for i := 0; i < 2; i++ {
+		if data, err := download("token-a", "Syllabus.pdf"); err != nil || data != content {
+			t.Fatalf("A got %q: %v", data, err)
+		}
+	}
+	if contentRequests != 1 {
+		t.Errorf("content downloaded %d times, want once", contentRequests)
+	}
+
+	// B can't read the file, the cached copy mustn't reach them
+	path := filepath.Join(t.TempDir(), "Syllabus.pdf")
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token-b"})
+	if _, err := DownloadDriveFile(context.Background(), ts, "file-syllabus", path, false, nil); err == nil {
+		t.Error("B downloaded a file they can't read")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("cached file written for B: %v", err)
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/oauth2"
+)
+
+// Generates a PKCE code verifier (RFC 7636): 43 URL-safe characters
+func GenerateCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating code verifier: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Options adding the S256 code challenge of a verifier to the authentication URL
+func CodeChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	sum := sha256.Sum256([]byte(verifier))
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(sum[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// Option sending the code verifier along with the authorization code
+func CodeVerifierOption(verifier string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("code_verifier", verifier)
+}
@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Transport shared by every Classroom and Drive client, set by InitAPITransport
+var APITransport http.RoundTripper = http.DefaultTransport
+
+// Retries failed idempotent requests with a jittered exponential backoff
+type RetryTransport struct {
+	Base       http.RoundTripper
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// Builds the shared API transport from API_MAX_RETRIES, API_RETRY_BASE_DELAY and API_RETRY_MAX_DELAY
+func InitAPITransport() error {
+	transport := &RetryTransport{
+		Base:       http.DefaultTransport,
+		MaxRetries: 5,
+		BaseDelay:  500 * time.Millisecond,
+		MaxDelay:   30 * time.Second,
+	}
+
+	if value := os.Getenv("API_MAX_RETRIES"); value != "" {
+		maxRetries, err := strconv.Atoi(value)
+		if err != nil || maxRetries < 0 {
+			return fmt.Errorf("invalid API_MAX_RETRIES %q", value)
+		}
+		transport.MaxRetries = maxRetries
+	}
+	for envVar, delay := range map[string]*time.Duration{
+		"API_RETRY_BASE_DELAY": &transport.BaseDelay,
+		"API_RETRY_MAX_DELAY":  &transport.MaxDelay,
+	} {
+		if value := os.Getenv(envVar); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s %q", envVar, value)
+			}
+			*delay = d
+		}
+	}
+
+	APITransport = transport
+	return nil
+}
+
+// Returns an HTTP client authenticating its requests with the token source and retrying them through APITransport
+func NewAPIClient(ts oauth2.TokenSource) *http.Client {
+	return &http.Client{
+		Transport: &oauth2.Transport{Source: ts, Base: APITransport},
+	}
+}
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if !isIdempotent(req) {
+		return base.RoundTrip(req)
+	}
+
+	// The caller's request mustn't be modified, each retry sends a clone with a fresh body
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := base.RoundTrip(attemptReq)
+		if attempt >= t.MaxRetries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			// The server's delay is followed up to MaxDelay, a bogus one mustn't stall the job
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok && retryAfter > delay {
+				delay = retryAfter
+				if delay > t.MaxDelay {
+					delay = t.MaxDelay
+				}
+			}
+			// Drain the body so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		log.Printf("[retry] %s %s: %s, retrying in %v (%d/%d)",
+			req.Method, req.URL.Redacted(), reason, delay.Round(time.Millisecond), attempt+1, t.MaxRetries)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		attemptReq = req.Clone(req.Context())
+		if req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("error rewinding request body: %w", err)
+			}
+			attemptReq.Body = body
+		}
+	}
+}
+
+// Full jitter: a random delay between 0 and the exponential backoff, capped at MaxDelay
+func (t *RetryTransport) backoff(attempt int) time.Duration {
+	delay := t.MaxDelay
+	if attempt < 30 {
+		if d := t.BaseDelay << attempt; d > 0 && d < t.MaxDelay {
+			delay = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// Only requests that can be sent twice without side effects are retried
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// Canceled requests stay canceled
+		return req.Context().Err() == nil && !errors.Is(err, context.Canceled)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Parses a Retry-After header, given either in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
+}
+
+// Returns an error describing the response if its status isn't a success
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected status %s from %s: %s", resp.Status, resp.Request.URL.Redacted(), body)
+}
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test server answering with the given statuses in turn, then 200
+// Records the body of every request it receives
+type statusServer struct {
+	mu         sync.Mutex
+	statuses   []int
+	retryAfter string
+	bodies     []string
+}
+
+func (s *statusServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	attempt := len(s.bodies)
+	s.bodies = append(s.bodies, string(body))
+	if attempt < len(s.statuses) {
+		if s.retryAfter != "" {
+			w.Header().Set("Retry-After", s.retryAfter)
+		}
+		w.WriteHeader(s.statuses[attempt])
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (s *statusServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func newRetryTransport(maxDelay time.Duration) *RetryTransport {
+	return &RetryTransport{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: maxDelay}
+}
+
+func TestRetryTransportRetriesThrottledRequests(t *testing.T) {
+	s := &statusServer{statuses: []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := req.Body
+	resp, err := newRetryTransport(10 * time.Millisecond).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d after retries, want 200", resp.StatusCode)
+	}
+	if requests := s.requests(); strings.Join(requests, ",") != "payload,payload,payload" {
+		t.Errorf("server received bodies %q, want the payload on each of the 3 attempts", requests)
+	}
+	if req.Body != body {
+		t.Error("the caller's request body was replaced")
+	}
+}
+
+func TestRetryTransportFollowsRetryAfter(t *testing.T) {
+	s := &statusServer{statuses: []int{http.StatusTooManyRequests}, retryAfter: "1"}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	resp, err := newRetryTransport(5 * time.Second).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); resp.StatusCode != http.StatusOK || elapsed < time.Second {
+		t.Errorf("got status %d after %v, want 200 after the server's delay of 1s", resp.StatusCode, elapsed)
+	}
+
+	// A delay past MaxDelay is capped
+	s = &statusServer{statuses: []int{http.StatusServiceUnavailable}, retryAfter: "3600"}
+	server = httptest.NewServer(s)
+	defer server.Close()
+	req, err = http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = time.Now()
+	resp, err = newRetryTransport(50 * time.Millisecond).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); resp.StatusCode != http.StatusOK || elapsed > 5*time.Second {
+		t.Errorf("got status %d after %v, want 200 once MaxDelay elapsed", resp.StatusCode, elapsed)
+	}
+}
+
+// Requests that can't be sent again as they were are returned after the first attempt
+func TestRetryTransportSendsUnrepeatableRequestsOnce(t *testing.T) {
+	for name, newRequest := range map[string]func(url string) (*http.Request, error){
+		"non-rewindable body": func(url string) (*http.Request, error) {
+			return http.NewRequest(http.MethodPut, url, io.NopCloser(strings.NewReader("payload")))
+		},
+		"non-idempotent method": func(url string) (*http.Request, error) {
+			return http.NewRequest(http.MethodPost, url, strings.NewReader("payload"))
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := &statusServer{statuses: []int{http.StatusServiceUnavailable}}
+			server := httptest.NewServer(s)
+			defer server.Close()
+
+			req, err := newRequest(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := newRetryTransport(10 * time.Millisecond).RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusServiceUnavailable || len(s.requests()) != 1 {
+				t.Errorf("got status %d after %d attempts, want 503 after 1", resp.StatusCode, len(s.requests()))
+			}
+		})
+	}
+}
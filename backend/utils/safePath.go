@@ -0,0 +1,152 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Longest name SafeName returns, in bytes. File systems allow 255, the rest is left for the
+// export extensions, de-duplication counters and temporary suffixes added later.
+const MaxNameBytes = 200
+
+// Characters Windows doesn't allow in names, plus the ones the downloader always replaced
+const invalidNameChars = `<>:"'°/\|?*`
+
+// Names Windows reserves for devices, whatever their extension
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"COM¹": true, "COM²": true, "COM³": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+	"LPT¹": true, "LPT²": true, "LPT³": true,
+}
+
+// Turns a name from Classroom or Drive into a single path element that is valid on every platform:
+// NFC normalized, without control or invalid characters, not a Windows reserved name, not "." nor "..",
+// and at most MaxNameBytes long, long names being cut and suffixed with a hash of the full name
+// Returns an empty string if nothing is left of the name
+func SafeName(name string) string {
+	name = norm.NFC.String(name)
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r), isBidiControl(r):
+			continue
+		case strings.ContainsRune(invalidNameChars, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	// Windows drops trailing dots and spaces, leading dots hide files elsewhere
+	safe := strings.Trim(b.String(), " .")
+	if safe == "" {
+		return ""
+	}
+
+	if isWindowsReservedName(safe) {
+		safe = "_" + safe
+	}
+
+	if len(safe) > MaxNameBytes {
+		safe = shortenName(safe, name, MaxNameBytes)
+	}
+	return safe
+}
+
+// Cuts a name to maxBytes, keeping its extension and suffixing it with a hash of the original name
+// so names that only differ past the cut stay different
+func shortenName(safe, original string, maxBytes int) string {
+	sum := sha256.Sum256([]byte(original))
+	suffix := "~" + hex.EncodeToString(sum[:])[:8]
+
+	ext := filepath.Ext(safe)
+	if len(ext) > 16 || len(ext) == len(safe) {
+		ext = ""
+	}
+	stem := truncateUTF8(strings.TrimSuffix(safe, ext), maxBytes-len(ext)-len(suffix))
+	return strings.TrimRight(stem, " .") + suffix + ext
+}
+
+// Cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func isWindowsReservedName(name string) bool {
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	return windowsReservedNames[strings.ToUpper(strings.TrimRight(base, " "))]
+}
+
+// Characters that reorder text, which can disguise a file's extension
+func isBidiControl(r rune) bool {
+	return (r >= '\u202A' && r <= '\u202E') || (r >= '\u2066' && r <= '\u2069') || r == '\u200E' || r == '\u200F' || r == '\u061C'
+}
+
+// Hands out paths no other path of the set uses, comparing them the way case-insensitive file systems do
+type UniquePaths struct {
+	used map[string]bool
+}
+
+func NewUniquePaths() *UniquePaths {
+	return &UniquePaths{used: make(map[string]bool)}
+}
+
+// Marks a path as used without checking it
+func (u *UniquePaths) Reserve(p string) {
+	u.used[pathKey(p)] = true
+}
+
+// Returns p, or p with a counter before the extension of its last element if p is already used
+// Set isDir for folders, whose names have no extension
+// The counter never pushes the last element past MaxNameBytes
+func (u *UniquePaths) Unique(p string, isDir bool) string {
+	if !u.used[pathKey(p)] {
+		u.Reserve(p)
+		return p
+	}
+
+	dir, name := filepath.Split(p)
+	ext := ""
+	if !isDir {
+		ext = filepath.Ext(name)
+		if len(ext) == len(name) {
+			ext = ""
+		}
+	}
+	stem := strings.TrimSuffix(name, ext)
+
+	for i := 2; ; i++ {
+		counter := fmt.Sprintf(" (%d)", i)
+		candidate := dir + truncateUTF8(stem, MaxNameBytes-len(counter)-len(ext)) + counter + ext
+		if !u.used[pathKey(candidate)] {
+			u.Reserve(candidate)
+			return candidate
+		}
+	}
+}
+
+func pathKey(p string) string {
+	return strings.ToLower(norm.NFC.String(filepath.Clean(p)))
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var nameSeeds = []string{
+	"", ".", "..", "...", " . ", "../../etc/passwd", `..\..\Windows`, "a/b", `C:\Users`, "/abs",
+	"CON", "con.txt", "LPT1 ", "Report.pdf", "report.PDF", "gpj.\u202Eexe", "nul\x00byte", "\xff\xfe",
+	strings.Repeat("é", 300) + ".pdf", strings.Repeat("a", 250),
+}
+
+// Reports whether p is root or a path under it
+func isUnder(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func FuzzSafeName(f *testing.F) {
+	for _, seed := range nameSeeds {
+		f.Add(seed)
+	}
+	root := filepath.Join("downloads", "job")
+
+	f.Fuzz(func(t *testing.T, name string) {
+		safe := SafeName(name)
+		if safe == "" {
+			return
+		}
+		if safe == "." || safe == ".." || strings.ContainsAny(safe, `/\`) {
+			t.Fatalf("SafeName(%q) = %q isn't a single path element", name, safe)
+		}
+		if !utf8.ValidString(safe) || len(safe) > MaxNameBytes {
+			t.Fatalf("SafeName(%q) = %q is invalid or longer than %d bytes", name, safe, MaxNameBytes)
+		}
+		if p := filepath.Join(root, safe); !isUnder(root, p) || filepath.Dir(p) != root {
+			t.Fatalf("SafeName(%q) = %q leaves %s as %s", name, safe, root, p)
+		}
+	})
+}
+
+func FuzzUniquePaths(f *testing.F) {
+	for _, seed := range nameSeeds {
+		f.Add(seed, seed)
+	}
+	root := filepath.Join("downloads", "job")
+
+	f.Fuzz(func(t *testing.T, folder, name string) {
+		used := NewUniquePaths()
+		seen := make(map[string]bool)
+		for _, isDir := range []bool{true, false, false, true} {
+			dir, file := SafeName(folder), SafeName(name)
+			if dir == "" {
+				dir = "_"
+			}
+			if file == "" {
+				file = "_"
+			}
+			p := filepath.Join(root, dir, file)
+
+			unique := used.Unique(p, isDir)
+			if !isUnder(root, unique) || filepath.Dir(unique) != filepath.Dir(p) {
+				t.Fatalf("Unique(%q) = %q moved out of its folder", p, unique)
+			}
+			if key := pathKey(unique); seen[key] {
+				t.Fatalf("Unique(%q) = %q was already handed out", p, unique)
+			} else {
+				seen[key] = true
+			}
+			if base := filepath.Base(unique); unique != p && len(base) > MaxNameBytes+len(filepath.Ext(file)) {
+				t.Fatalf("Unique(%q) = %q has a name of %d bytes", p, unique, len(base))
+			}
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prefix of the tokens encrypted by EncryptToken, followed by the key ID and the sealed token
+const encryptedTokenPrefix = "enc:"
+
+var (
+	tokenKeys        map[string]cipher.AEAD
+	activeTokenKeyID string
+)
+
+// Loads the token encryption keys from TOKEN_ENCRYPTION_KEYS
+// Keys are listed as id:base64key separated by commas, the first one encrypts and all of them decrypt
+func InitTokenKeys() error {
+	entries := strings.Split(os.Getenv("TOKEN_ENCRYPTION_KEYS"), ",")
+	tokenKeys = make(map[string]cipher.AEAD, len(entries))
+	activeTokenKeyID = ""
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encodedKey, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return fmt.Errorf("invalid token encryption key %q, expected id:base64key", entry)
+		}
+		if _, exists := tokenKeys[id]; exists {
+			return fmt.Errorf("duplicate token encryption key ID %q", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return fmt.Errorf("error decoding token encryption key %q: %w", id, err)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("token encryption key %q must be 32 bytes long, got %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("error creating cipher for key %q: %w", id, err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("error creating GCM for key %q: %w", id, err)
+		}
+
+		tokenKeys[id] = gcm
+		if activeTokenKeyID == "" {
+			activeTokenKeyID = id
+		}
+	}
+
+	if activeTokenKeyID == "" {
+		return fmt.Errorf("TOKEN_ENCRYPTION_KEYS is not set")
+	}
+	return nil
+}
+
+// Encrypts a token with the active key
+// The key ID is stored along with the token so it can still be decrypted after a rotation
+func EncryptToken(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+
+	gcm, ok := tokenKeys[activeTokenKeyID]
+	if !ok {
+		return "", fmt.Errorf("token encryption keys are not initialized")
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("error generating nonce: %w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(token), []byte(activeTokenKeyID))
+
+	return encryptedTokenPrefix + activeTokenKeyID + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a token encrypted by EncryptToken
+// Tokens stored before encryption was introduced are returned as they are
+func DecryptToken(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedTokenPrefix) {
+		return stored, nil
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(stored, encryptedTokenPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted token")
+	}
+	gcm, ok := tokenKeys[id]
+	if !ok {
+		return "", fmt.Errorf("unknown token encryption key %q", id)
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("error decoding encrypted token: %w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted token")
+	}
+
+	token, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("error decrypting token: %w", err)
+	}
+	return string(token), nil
+}
+
+// Reports whether a stored token is in plaintext or encrypted with a key other than the active one
+func NeedsTokenReencryption(stored string) bool {
+	if stored == "" {
+		return false
+	}
+	return !strings.HasPrefix(stored, encryptedTokenPrefix+activeTokenKeyID+":")
+}
@@ -1,26 +1,29 @@
 package utils
 
 import (
-	"archive/zip"
 	"context"
+	"crypto/md5"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/joho/godotenv"
 	"golang.org/x/oauth2"
-	"google.golang.org/api/drive/v2"
+	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
 	"gorm.io/gorm/logger"
+
+	"github.com/mspcix/google-classroom-course-downloader/storage"
 )
 
 type GormLogger struct {
@@ -34,11 +37,17 @@ var (
 	ZIP_FILE_NAME         string
 	OAuthConfig           *oauth2.Config
 	DownloadFolderPath, _ string
-	ZipFilePath           string
 	Logger                *log.Logger
 	DBLogger              GormLogger
+	ClassroomAPIURL       string
+	DriveAPIURL           string
+	StoredExtensions      map[string]bool
+	ContentStorage        storage.Storage // Where the downloaded files are kept, chosen by STORAGE_BACKEND
+	PresignExpiry         = 15 * time.Minute
 )
 
+const defaultStoredExtensions = ".pdf,.jpg,.jpeg,.png,.gif,.webp,.mp3,.mp4,.m4a,.mov,.webm,.zip,.gz,.7z,.rar,.docx,.xlsx,.pptx,.odt,.ods,.odp"
+
 func InitEnv() error {
 	if err := godotenv.Load(); err != nil {
 		return fmt.Errorf("error loading .env file: %w", err)
@@ -47,9 +56,44 @@ func InitEnv() error {
 	SystemDownloadFolder = os.Getenv("SYSTEM_DOWNLOAD_FOLDER")
 	DownloadFolder = os.Getenv("DOWNLOAD_FOLDER")
 
+	// Both can point to a fake server, the Drive one is only overridden when set
+	ClassroomAPIURL = os.Getenv("CLASSROOM_API_URL")
+	if ClassroomAPIURL == "" {
+		ClassroomAPIURL = "https://classroom.googleapis.com"
+	}
+	DriveAPIURL = os.Getenv("DRIVE_API_URL")
+
+	if err := InitExportFormats(); err != nil {
+		return err
+	}
+
+	if err := InitTokenKeys(); err != nil {
+		return err
+	}
+
+	if err := InitAPITransport(); err != nil {
+		return err
+	}
+
+	InitStoredExtensions()
+
+	if err := InitFileCache(); err != nil {
+		return err
+	}
+
 	DownloadFolderPath = DefineDownloadPath()
 	ZIP_FILE_NAME = DownloadFolder + ".zip"
-	ZipFilePath = DownloadFolderPath + ".zip"
+
+	// Local storage keeps the files under DownloadFolderPath, as before storage backends
+	var err error
+	if ContentStorage, err = storage.FromEnv(DownloadFolderPath); err != nil {
+		return err
+	}
+	if value := os.Getenv("PRESIGN_EXPIRY"); value != "" {
+		if PresignExpiry, err = time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid PRESIGN_EXPIRY %q: %w", value, err)
+		}
+	}
 
 	log.Println("------------------------------------------------------")
 	log.Println("------------------------------------------------------")
@@ -57,7 +101,6 @@ func InitEnv() error {
 	log.Printf("DownloadFolder: %s\n", DownloadFolder)
 	log.Printf("DownloadFolderPath: %s\n", DownloadFolderPath)
 	log.Printf("ZIP_FILE_NAME: %s\n", ZIP_FILE_NAME)
-	log.Printf("ZipFilePath: %s\n", ZipFilePath)
 	log.Println("------------------------------------------------------")
 	log.Println("------------------------------------------------------")
 
@@ -92,50 +135,216 @@ func InitOauthConfig() error {
 	return nil
 }
 
-func RemoveInvalidChars(fileName string) string {
-	// Define a regular expression pattern to match invalid characters
-	invalidCharPattern := regexp.MustCompile(`[<>:"'°/\\|?*]`)
+// Returned when a downloaded file doesn't match the size or checksum Drive reports for it
+var ErrDownloadMismatch = errors.New("downloaded file doesn't match its drive metadata")
 
-	// Replace invalid characters with an underscore
-	sanitizedFileName := invalidCharPattern.ReplaceAllString(fileName, "_")
+// Metadata Drive reports for a file
+// Google Workspace files have no checksum nor size, so their exports can't be verified
+type DriveFileMetadata struct {
+	MimeType     string
+	MD5Checksum  string
+	Size         int64
+	ModifiedTime *time.Time
+}
 
-	// Also trim leading and trailing whitespace and dots
-	sanitizedFileName = strings.Trim(sanitizedFileName, " .")
+// A Drive file saved to disk
+type DriveDownload struct {
+	Path string // Where the file was saved, with the extension of its export format if it was exported
+	Size int64
+	MD5  string // In hex
 
-	return sanitizedFileName
+	Metadata DriveFileMetadata
 }
 
-func DownloadDriveFile(token *string, fileID, filePath string) error {
-	ctx := context.Background()
+// Checks the saved file against the size and checksum reported by Drive
+func (d *DriveDownload) Verify() error {
+	if d.Metadata.Size > 0 && d.Size != d.Metadata.Size {
+		return fmt.Errorf("%w: got %d bytes, expected %d", ErrDownloadMismatch, d.Size, d.Metadata.Size)
+	}
+	if d.Metadata.MD5Checksum != "" && !strings.EqualFold(d.MD5, d.Metadata.MD5Checksum) {
+		return fmt.Errorf("%w: got md5 %s, expected %s", ErrDownloadMismatch, d.MD5, d.Metadata.MD5Checksum)
+	}
+	return nil
+}
 
+// Downloads a Drive file to filePath and verifies it against its Drive metadata
+// With resume, a partial file left at filePath by an earlier attempt is continued with a Range request
+// instead of being downloaded again. Exported files can't be ranged and always start over.
+// The file is taken from DriveFileCache when it holds the same version, but only once the metadata
+// request made with the user's token has shown the user can read it.
+// onProgress, if not nil, is called with the number of bytes written by each write
+// On ErrDownloadMismatch the download is returned along with the error, to report what was received
+func DownloadDriveFile(ctx context.Context, ts oauth2.TokenSource, fileID, filePath string, resume bool, onProgress func(n int64)) (*DriveDownload, error) {
 	// Set up the Drive API client
-	client := getClient(ctx, *token)
+	client := getClient(ctx, ts)
 
-	// Download the file content
-	resp, err := client.Files.Get(fileID).Download()
+	// Google Workspace files have no content of their own and must be exported
+	file, err := client.Files.Get(fileID).Fields("id", "name", "mimeType", "size", "md5Checksum", "modifiedTime").SupportsAllDrives(true).Context(ctx).Do()
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("error retrieving drive file metadata: %w", err)
+	}
+	metadata := DriveFileMetadata{MimeType: file.MimeType, MD5Checksum: file.Md5Checksum, Size: file.Size}
+	if modifiedTime, err := time.Parse(time.RFC3339, file.ModifiedTime); err == nil {
+		metadata.ModifiedTime = &modifiedTime
+	}
+
+	exportMimeType := ""
+	if format, ok := ExportFormats[file.MimeType]; ok {
+		exportMimeType = format.MimeType
+		filePath = WithExtension(filePath, format.Extension)
+	} else if IsGoogleWorkspaceMimeType(file.MimeType) {
+		return nil, fmt.Errorf("drive file %s of type %s can't be exported", fileID, file.MimeType)
+	}
+
+	// A file is only cached with something telling its versions apart
+	cacheKey := ""
+	if DriveFileCache != nil && (file.Md5Checksum != "" || file.ModifiedTime != "") {
+		cacheKey = CacheKey(fileID, file.Md5Checksum, file.ModifiedTime, exportMimeType)
+		if download, ok := fromCache(cacheKey, filePath, metadata); ok {
+			return download, nil
+		}
+	}
+
+	download, err := downloadDriveContent(ctx, client, fileID, exportMimeType, filePath, resume, metadata, onProgress)
+	if err == nil && cacheKey != "" {
+		if err := DriveFileCache.Put(cacheKey, download.Path); err != nil {
+			log.Printf("[cache] error caching drive file %s: %v", fileID, err)
+		}
+	}
+	return download, err
+}
+
+// Puts the cached version of a file at filePath, reporting false if there's none or it's damaged
+func fromCache(key, filePath string, metadata DriveFileMetadata) (*DriveDownload, bool) {
+	ok, err := DriveFileCache.Get(key, filePath)
+	if err != nil {
+		log.Printf("[cache] error reading %s: %v", key, err)
+	}
+	if !ok {
+		return nil, false
+	}
+
+	download, err := verifiedDownload(hashDownload(filePath, metadata))
+	if err != nil {
+		log.Printf("[cache] ignoring %s: %v", key, err)
+		return nil, false
+	}
+	return download, true
+}
+
+// Downloads the content of a Drive file, or its export when exportMimeType is set
+func downloadDriveContent(ctx context.Context, client *drive.Service, fileID, exportMimeType, filePath string, resume bool, metadata DriveFileMetadata, onProgress func(n int64)) (*DriveDownload, error) {
+	var resp *http.Response
+	var offset int64
+	var err error
+	if exportMimeType != "" {
+		resp, err = client.Files.Export(fileID, exportMimeType).Context(ctx).Download()
+	} else {
+		if resume {
+			offset = partialSize(filePath, metadata.Size)
+		}
+		if offset > 0 && offset == metadata.Size {
+			// The earlier attempt got the whole file
+			return verifiedDownload(hashDownload(filePath, metadata))
+		}
+
+		call := client.Files.Get(fileID).SupportsAllDrives(true).Context(ctx)
+		if offset > 0 {
+			call.Header().Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err = call.Download()
+	}
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	// Create the local file
-	localFile, err := os.Create(filePath)
+	// Drive may answer with the whole file, in which case the partial one is dropped
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 && resp.StatusCode == http.StatusPartialContent {
+		flags = os.O_CREATE | os.O_RDWR
+	} else {
+		offset = 0
+	}
+
+	localFile, err := os.OpenFile(filePath, flags, 0644)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer localFile.Close()
 
+	// The checksum covers the bytes already on disk as well as the new ones
+	hash := md5.New()
+	if offset > 0 {
+		if _, err := io.CopyN(hash, localFile, offset); err != nil {
+			return nil, fmt.Errorf("error reading partial file %s: %w", filePath, err)
+		}
+	}
+
 	// Copy the downloaded content to the local file
-	_, err = io.Copy(localFile, resp.Body)
+	dst := io.MultiWriter(localFile, hash)
+	if onProgress != nil {
+		dst = io.MultiWriter(dst, ProgressWriter(onProgress))
+	}
+	n, err := io.Copy(dst, resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return verifiedDownload(&DriveDownload{
+		Path:     filePath,
+		Size:     offset + n,
+		MD5:      hex.EncodeToString(hash.Sum(nil)),
+		Metadata: metadata,
+	}, nil)
+}
+
+func verifiedDownload(download *DriveDownload, err error) (*DriveDownload, error) {
+	if err != nil {
+		return nil, err
+	}
+	return download, download.Verify()
+}
+
+// Returns the size of the partial file at filePath that can be continued, or 0 to start over
+func partialSize(filePath string, size int64) int64 {
+	info, err := os.Stat(filePath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > size {
+		return 0
+	}
+	return info.Size()
+}
+
+// Describes a file already fully downloaded
+func hashDownload(filePath string, metadata DriveFileMetadata) (*DriveDownload, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := md5.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filePath, err)
+	}
+	return &DriveDownload{Path: filePath, Size: n, MD5: hex.EncodeToString(hash.Sum(nil)), Metadata: metadata}, nil
 }
 
-func getClient(ctx context.Context, token string) *drive.Service {
-	svc, err := drive.NewService(ctx, option.WithTokenSource(OAuthConfig.TokenSource(ctx, &oauth2.Token{AccessToken: token})))
+// Reports the size of every write to a callback
+type ProgressWriter func(n int64)
+
+func (pw ProgressWriter) Write(p []byte) (int, error) {
+	pw(int64(len(p)))
+	return len(p), nil
+}
+
+func getClient(ctx context.Context, ts oauth2.TokenSource) *drive.Service {
+	opts := []option.ClientOption{option.WithHTTPClient(NewAPIClient(ts))}
+	if DriveAPIURL != "" {
+		opts = append(opts, option.WithEndpoint(strings.TrimSuffix(DriveAPIURL, "/")+"/drive/v3/"))
+	}
+	svc, err := drive.NewService(ctx, opts...)
 	if err != nil {
 		log.Fatalf("Unable to create Drive service: %v", err)
 	}
@@ -156,77 +365,25 @@ func MakeFolderNameFromTime(creationTime string) string {
 	return creationDate
 }
 
-// Create a zip file from a folder
-func createZip(sourceDir, zipFilePath string) error {
-	zipFile, err := os.Create(zipFilePath)
-	if err != nil {
-		return err
+// Reads the extensions of already compressed files from STORED_EXTENSIONS
+// Deflating them again costs time without making them smaller
+func InitStoredExtensions() {
+	extensions := os.Getenv("STORED_EXTENSIONS")
+	if extensions == "" {
+		extensions = defaultStoredExtensions
 	}
-	defer zipFile.Close()
-
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
-
-	return filepath.Walk(sourceDir, func(filePath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if !info.IsDir() {
-			relPath, err := filepath.Rel(sourceDir, filePath)
-			if err != nil {
-				return err
-			}
-
-			zipFile, err := zipWriter.Create(relPath)
-			if err != nil {
-				return err
-			}
-
-			file, err := os.Open(filePath)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-
-			_, err = io.Copy(zipFile, file)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-}
-
-func ZipFolder(sourceDir string) error {
-	// Create a zip file with the same name as the folder
-	ZipFilePath = sourceDir + ".zip"
-	log.Printf("Zipping folder %s...\n", ZipFilePath)
 
-	// Close any open file handles within the directory
-	if err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	StoredExtensions = make(map[string]bool)
+	for _, ext := range strings.Split(extensions, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
 		}
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
 		}
-		return nil
-	}); err != nil {
-		return err
+		StoredExtensions[ext] = true
 	}
-
-	// Create the zip file
-	err := createZip(sourceDir, ZipFilePath)
-	if err != nil {
-		return err
-	}
-
-	return nil
 }
 
 func DefineDownloadPath() string {
@@ -243,6 +400,22 @@ func DefineDownloadPath() string {
 	return downloadPath
 }
 
+// Returns the local folder holding the Drive files of a download job while they download
+// Finished files are moved to ContentStorage, only partial ones stay here to be resumed
+func WorkspacePath(gcuid, jobID string) string {
+	return filepath.Join(DownloadFolderPath, ".partial", filepath.Base(gcuid), filepath.Base(jobID))
+}
+
+// Returns the prefix of the storage keys of a job's files
+func JobKeyPrefix(gcuid, jobID string) string {
+	return storage.Key(filepath.Base(gcuid), filepath.Base(jobID)) + "/"
+}
+
+// Removes a job's workspace
+func RemoveWorkspace(workspacePath string) error {
+	return os.RemoveAll(workspacePath)
+}
+
 // Generates a random session ID
 // Returns a unique session identifier
 func GenerateRandomID(IDlength int) string {
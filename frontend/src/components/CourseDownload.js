@@ -1,28 +1,51 @@
 import React, { useState } from 'react';
 import { useNavigate } from 'react-router-dom'
 
+const JOB_POLL_INTERVAL = 2000; // ms
+
+// Statuses a job doesn't leave unless it's resumed
+const isFinished = (status) => status === 'done' || status === 'failed' || status === 'partial';
+
 const CourseDownload = ({ selectedCoursesIDs }) => {
     const [isDownloading, setIsDownloading] = useState(false);
+    const [jobStatus, setJobStatus] = useState(null);
+    const [progress, setProgress] = useState(null);
+    const [layout, setLayout] = useState('topic');
+    const [format, setFormat] = useState('zip');
+    const [jobId, setJobId] = useState(null);
+    const [failures, setFailures] = useState([]);
     const navigate = useNavigate();
 
     const handleDownload = async () => {
         try {
             setIsDownloading(true);
+            setJobStatus(null);
+            setProgress(null);
+            setJobId(null);
+            setFailures([]);
             const response = await fetch('/api/courses/download', {
                 credentials: 'include',
                 method: 'POST',
                 headers: {
                     'Content-Type': 'application/json',
                 },
-                body: JSON.stringify({ selectedCoursesIDs }),
+                body: JSON.stringify({ selectedCoursesIDs, layout }),
             });
 
             if (response.status === 401) {
                 navigate('/');
-            } else {
-                console.log('Download initiated successfully.');
-                generateDownloadLink();
+                return;
+            }
+            if (response.status === 403) {
+                const { forbiddenCourseIDs } = await response.json();
+                console.error('Not enrolled in courses:', forbiddenCourseIDs);
+                setJobStatus('failed');
+                return;
             }
+
+            const { jobId } = await response.json();
+            setJobId(jobId);
+            await finishJob(jobId);
         } catch (error) {
             console.error('Error sending download request:', error);
         } finally {
@@ -30,20 +53,156 @@ const CourseDownload = ({ selectedCoursesIDs }) => {
         }
     };
 
-    const generateDownloadLink = () => {
-        // const downloadLink = document.createElement('a');
-        // downloadLink.href = '/api/courses/serve';
-        // downloadLink.target = '_blank'; // Open in a new tab
-        // downloadLink.download = 'downloaded_courses.zip'; // Specify the download file name
-        // downloadLink.click();
+    // Runs the failed or partial job again, skipping the files it already downloaded
+    const handleResume = async () => {
+        try {
+            setIsDownloading(true);
+            setJobStatus(null);
+            setProgress(null);
+            const response = await fetch(`/api/jobs/${jobId}/resume`, {
+                credentials: 'include',
+                method: 'POST',
+            });
+
+            if (response.status === 401) {
+                navigate('/');
+                return;
+            }
+            if (!response.ok && response.status !== 409) {
+                setJobStatus('failed');
+                return;
+            }
+
+            // 409 means the job is already running, so it is followed all the same
+            await finishJob(jobId);
+        } catch (error) {
+            console.error('Error resuming download:', error);
+        } finally {
+            setIsDownloading(false);
+        }
+    };
+
+    const finishJob = async (jobId) => {
+        const job = await followJob(jobId);
+        setJobStatus(job.status);
+        if (job.status === 'done' || job.status === 'partial') {
+            generateDownloadLink(jobId);
+            await fetchFailures(jobId);
+        } else {
+            console.error('Download job failed:', job.error);
+        }
+    };
+
+    // Lists the files of the job that couldn't be downloaded or didn't match Drive
+    const fetchFailures = async (jobId) => {
+        const response = await fetch(`/api/jobs/${jobId}/report`, { credentials: 'include' });
+        if (!response.ok) {
+            return;
+        }
+        const report = await response.json();
+        setFailures(report.failures);
+    };
+
+    // Follows the job progress stream until the job is finished
+    // Falls back to polling if the stream can't be opened
+    const followJob = (jobId) => new Promise((resolve, reject) => {
+        const events = new EventSource(`/api/jobs/${jobId}/events`, { withCredentials: true });
+        let received = false;
+
+        events.onmessage = (message) => {
+            received = true;
+            const event = JSON.parse(message.data);
+            setProgress(event);
+            if (event.status) {
+                setJobStatus(event.status);
+            }
+            if (isFinished(event.status)) {
+                events.close();
+                resolve({ status: event.status, error: event.error });
+            }
+        };
+
+        events.onerror = () => {
+            events.close();
+            if (!received) {
+                console.warn('Progress stream unavailable, polling job status instead.');
+            }
+            waitForJob(jobId).then(resolve, reject);
+        };
+    });
+
+    // Polls the job status until the job is finished
+    const waitForJob = async (jobId) => {
+        for (;;) {
+            const response = await fetch(`/api/jobs/${jobId}`, { credentials: 'include' });
+            if (response.status === 401) {
+                navigate('/');
+                throw new Error('Not authenticated');
+            }
+
+            const job = await response.json();
+            setJobStatus(job.status);
+            if (isFinished(job.status)) {
+                return job;
+            }
+            await new Promise(resolve => setTimeout(resolve, JOB_POLL_INTERVAL));
+        }
+    };
+
+    const generateDownloadLink = (jobId) => {
+        const downloadLink = document.createElement('a');
+        downloadLink.href = `/api/jobs/${jobId}/serve?format=${format}`;
+        downloadLink.download = `downloaded_courses.${format}`; // Specify the download file name
+        downloadLink.click();
     };
 
     return (
         <div>
             <h2>Download Selected Courses</h2>
+            <label>
+                Organize by{' '}
+                <select value={layout} onChange={(e) => setLayout(e.target.value)} disabled={isDownloading}>
+                    <option value="topic">Topic</option>
+                    <option value="date">Date</option>
+                </select>
+            </label>
+            <label>
+                Archive{' '}
+                <select value={format} onChange={(e) => setFormat(e.target.value)} disabled={isDownloading}>
+                    <option value="zip">.zip</option>
+                    <option value="tar.gz">.tar.gz</option>
+                    <option value="tar.zst">.tar.zst</option>
+                </select>
+            </label>
             <button onClick={handleDownload} disabled={isDownloading || selectedCoursesIDs.length === 0}>
                 {isDownloading ? 'Downloading...' : 'Download'}
             </button>
+            {jobStatus === 'queued' && <p>Waiting for other downloads to finish...</p>}
+            {isDownloading && progress && progress.totalItems > 0 && (
+                <div>
+                    <progress value={progress.finishedItems} max={progress.totalItems} />
+                    <p>
+                        {progress.finishedItems} / {progress.totalItems} items
+                        ({(progress.bytesWritten / (1024 * 1024)).toFixed(1)} MB)
+                        {progress.courseName && ` - ${progress.courseName}`}
+                        {progress.item && `: ${progress.item}`}
+                    </p>
+                </div>
+            )}
+            {jobStatus === 'failed' && <p style={{ color: 'red' }}>Download failed. Please try again later.</p>}
+            {failures.length > 0 && (
+                <div>
+                    <p style={{ color: 'red' }}>{failures.length} file(s) couldn't be downloaded:</p>
+                    <ul>
+                        {failures.map((failure) => (
+                            <li key={`${failure.kind}-${failure.materialId}`}>{failure.filePath}: {failure.error}</li>
+                        ))}
+                    </ul>
+                </div>
+            )}
+            {(jobStatus === 'failed' || jobStatus === 'partial') && jobId && !isDownloading && (
+                <button onClick={handleResume}>Resume download</button>
+            )}
         </div>
     );
 };
@@ -4,12 +4,32 @@ import { useNavigate } from 'react-router-dom';
 const CourseSelection = ({ selectedCoursesIDs, onCourseSelection }) => {
     const [courses, setCourses] = useState([]);
     const [fetchingStatus, setFetchingStatus] = useState('loading'); // 'loading', 'success', 'error'
+    const [includeArchived, setIncludeArchived] = useState(true);
     const navigate = useNavigate();
 
     useEffect(() => {
         fetchCourses();
     }, []);
 
+    // Picks up content posted since the courses were first discovered
+    const syncCourses = async () => {
+        try {
+            setFetchingStatus('loading');
+            const courseStates = includeArchived ? 'ACTIVE,ARCHIVED' : 'ACTIVE';
+            const response = await fetch(`/api/courses/discover?sync=true&courseStates=${courseStates}`, {
+                credentials: 'include',
+                redirect: 'manual',
+            });
+            if (response.status === 401) {
+                navigate('/');
+                return;
+            }
+        } catch (error) {
+            console.error('Error syncing courses:', error);
+        }
+        fetchCourses();
+    };
+
     const fetchCourses = async () => {
         try {
             const response = await fetch('/api/courses/list', {
@@ -44,6 +64,15 @@ const CourseSelection = ({ selectedCoursesIDs, onCourseSelection }) => {
             {fetchingStatus === 'success' && courses && courses.length > 0 && (
                 <div>
                     <h2>Select Courses</h2>
+                    <button onClick={syncCourses}>Refresh courses</button>
+                    <label>
+                        <input
+                            type="checkbox"
+                            checked={includeArchived}
+                            onChange={(e) => setIncludeArchived(e.target.checked)}
+                        />
+                        Include archived courses
+                    </label>
                     <ul>
                         {courses.map(course => (
                             <li key={course.id}>